@@ -0,0 +1,198 @@
+// Package broker is the partitioned log SLOPS runs on: a Kafka cluster, or an in-process
+// log that runs the producer and the consumer without a cluster, in tests for instance.
+package broker
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// Broker is a partitioned log that keeps the messages of each partition in order.
+// Messages are sarama's, so the same code runs against Kafka and against the in-process log.
+type Broker interface {
+	// NewProducer returns a producer that writes every message to its `Partition`.
+	NewProducer() (Producer, error)
+	// ConsumePartition reads a partition in order, starting at an offset or at
+	// sarama.OffsetOldest or sarama.OffsetNewest.
+	ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error)
+	// NewestOffset returns the offset the next message written to a partition gets.
+	NewestOffset(topic string, partition int32) (int64, error)
+	// Commit records the next offset a consumer group reads from a partition.
+	Commit(group, topic string, partition int32, offset int64) error
+	// Committed returns the next offset a consumer group reads from a partition, sarama.OffsetOldest if it never committed.
+	Committed(group, topic string, partition int32) (int64, error)
+	// NewConsumerGroup joins a consumer group.
+	NewConsumerGroup(group string) (ConsumerGroup, error)
+	Close() error
+}
+
+// Producer writes messages asynchronously. Every message comes back on Successes or Errors,
+// which must be read. sarama.AsyncProducer is a Producer.
+type Producer interface {
+	Input() chan<- *sarama.ProducerMessage
+	Successes() <-chan *sarama.ProducerMessage
+	Errors() <-chan *sarama.ProducerError
+	Close() error
+}
+
+// PartitionConsumer delivers the messages of a partition in offset order.
+// sarama.PartitionConsumer is a PartitionConsumer.
+type PartitionConsumer interface {
+	Messages() <-chan *sarama.ConsumerMessage
+	Close() error
+}
+
+// ConsumerGroup reads topics as a member of a consumer group, which shares their partitions
+// between its members and commits the offsets they mark. sarama.ConsumerGroup is a ConsumerGroup.
+type ConsumerGroup interface {
+	// Consume joins a session of the group and hands each partition it claims to `handler`.
+	// It returns once the session ends, and is called again to join the next one.
+	Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error
+	Errors() <-chan error
+	Close() error
+}
+
+// KafkaBroker is a Kafka cluster.
+type KafkaBroker struct {
+	client sarama.Client
+
+	mu       sync.Mutex
+	consumer sarama.Consumer                                    // Created on the first ConsumePartition.
+	offsets  map[string]sarama.OffsetManager                    // Offset manager of each group.
+	poms     map[string]map[int32]sarama.PartitionOffsetManager // Partition offset managers by group and topic.
+}
+
+// NewKafkaBroker connects to a Kafka cluster.
+func NewKafkaBroker(brokers []string, config *sarama.Config) (*KafkaBroker, error) {
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaBroker{
+		client:  client,
+		offsets: map[string]sarama.OffsetManager{},
+		poms:    map[string]map[int32]sarama.PartitionOffsetManager{},
+	}, nil
+}
+
+// Client returns the client of the cluster.
+func (kb *KafkaBroker) Client() sarama.Client {
+	return kb.client
+}
+
+// NewProducer implements Broker.
+func (kb *KafkaBroker) NewProducer() (Producer, error) {
+	return sarama.NewAsyncProducerFromClient(kb.client)
+}
+
+// NewConsumerGroup implements Broker. The group shares the broker's client,
+// which stays open when the group is closed.
+func (kb *KafkaBroker) NewConsumerGroup(group string) (ConsumerGroup, error) {
+	return sarama.NewConsumerGroupFromClient(group, kb.client)
+}
+
+// ConsumePartition implements Broker.
+func (kb *KafkaBroker) ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error) {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	if kb.consumer == nil {
+		consumer, err := sarama.NewConsumerFromClient(kb.client)
+		if err != nil {
+			return nil, err
+		}
+		kb.consumer = consumer
+	}
+	return kb.consumer.ConsumePartition(topic, partition, offset)
+}
+
+// NewestOffset implements Broker.
+func (kb *KafkaBroker) NewestOffset(topic string, partition int32) (int64, error) {
+	return kb.client.GetOffset(topic, partition, sarama.OffsetNewest)
+}
+
+// pom returns the offset manager of a partition for a group. Callers hold the lock.
+func (kb *KafkaBroker) pom(group, topic string, partition int32) (sarama.PartitionOffsetManager, error) {
+	om, ok := kb.offsets[group]
+	if !ok {
+		var err error
+		if om, err = sarama.NewOffsetManagerFromClient(group, kb.client); err != nil {
+			return nil, err
+		}
+		kb.offsets[group] = om
+	}
+	id := group + "/" + topic
+	if pom, ok := kb.poms[id][partition]; ok {
+		return pom, nil
+	}
+	pom, err := om.ManagePartition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	if kb.poms[id] == nil {
+		kb.poms[id] = map[int32]sarama.PartitionOffsetManager{}
+	}
+	kb.poms[id][partition] = pom
+	return pom, nil
+}
+
+// Commit implements Broker.
+func (kb *KafkaBroker) Commit(group, topic string, partition int32, offset int64) error {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	pom, err := kb.pom(group, topic, partition)
+	if err != nil {
+		return err
+	}
+	pom.MarkOffset(offset, "")
+	kb.offsets[group].Commit()
+	return nil
+}
+
+// Committed implements Broker. The offset is fetched from the group coordinator,
+// so it follows the commits of every member of the group.
+func (kb *KafkaBroker) Committed(group, topic string, partition int32) (int64, error) {
+	coordinator, err := kb.client.Coordinator(group)
+	if err != nil {
+		return 0, err
+	}
+	req := &sarama.OffsetFetchRequest{Version: 1, ConsumerGroup: group}
+	req.AddPartition(topic, partition)
+	resp, err := coordinator.FetchOffset(req)
+	if err != nil {
+		return 0, err
+	}
+	block := resp.GetBlock(topic, partition)
+	if block == nil {
+		return 0, sarama.ErrIncompleteResponse
+	}
+	if block.Err != sarama.ErrNoError {
+		return 0, block.Err
+	}
+	if block.Offset < 0 {
+		return sarama.OffsetOldest, nil
+	}
+	return block.Offset, nil
+}
+
+// Close implements Broker.
+func (kb *KafkaBroker) Close() error {
+	kb.mu.Lock()
+	defer kb.mu.Unlock()
+
+	for _, poms := range kb.poms {
+		for _, pom := range poms {
+			pom.Close()
+		}
+	}
+	for _, om := range kb.offsets {
+		om.Close()
+	}
+	if kb.consumer != nil {
+		kb.consumer.Close()
+	}
+	return kb.client.Close()
+}
@@ -0,0 +1,204 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// NewConsumerGroup implements Broker.
+// A consumer group of the in-process log has a single member, which claims every partition
+// of the topics it consumes, starting after the offsets the group committed.
+// Offsets are committed as soon as they are marked.
+func (mb *MemoryBroker) NewConsumerGroup(group string) (ConsumerGroup, error) {
+	return &memGroup{
+		broker: mb,
+		group:  group,
+		errors: make(chan error, 256),
+	}, nil
+}
+
+// memGroup is a consumer group of a MemoryBroker.
+type memGroup struct {
+	broker *MemoryBroker
+	group  string
+
+	mu         sync.Mutex
+	generation int32
+	errors     chan error // Errors of the handlers, dropped once the buffer is full.
+	closed     bool
+	sessions   map[*memSession]context.CancelFunc
+}
+
+// Consume implements ConsumerGroup. Like with sarama, the session ends once the context is done,
+// the group is closed or the handler returns from one of the claims.
+func (g *memGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	if len(topics) == 0 {
+		return errors.New("no topics to consume")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return sarama.ErrClosedConsumerGroup
+	}
+	g.generation++
+	sess := &memSession{group: g, ctx: ctx, generation: g.generation, claims: map[string][]int32{}}
+	if g.sessions == nil {
+		g.sessions = map[*memSession]context.CancelFunc{}
+	}
+	g.sessions[sess] = cancel
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.sessions, sess)
+		g.mu.Unlock()
+	}()
+
+	claims := make([]*memClaim, 0)
+	defer func() {
+		for _, claim := range claims {
+			claim.consumer.Close()
+		}
+	}()
+	for _, topic := range topics {
+		for partition := int32(0); partition < g.broker.partitions; partition++ {
+			offset, err := g.broker.Committed(g.group, topic, partition)
+			if err != nil {
+				return err
+			}
+			pc, err := g.broker.ConsumePartition(topic, partition, offset)
+			if err != nil {
+				return err
+			}
+			claims = append(claims, &memClaim{broker: g.broker, topic: topic, partition: partition, offset: offset, consumer: pc})
+			sess.claims[topic] = append(sess.claims[topic], partition)
+		}
+	}
+
+	if err := handler.Setup(sess); err != nil {
+		return err
+	}
+	// The messages of the claims end with the session, for handlers that do not watch its context.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		for _, claim := range claims {
+			claim.consumer.Close()
+		}
+	}()
+	var wg sync.WaitGroup
+	for _, claim := range claims {
+		wg.Add(1)
+		go func(claim *memClaim) {
+			defer wg.Done()
+			defer cancel()
+			if err := handler.ConsumeClaim(sess, claim); err != nil {
+				g.handleError(err)
+			}
+		}(claim)
+	}
+	wg.Wait()
+	<-stopped
+	return handler.Cleanup(sess)
+}
+
+// handleError hands an error of a handler to Errors.
+func (g *memGroup) handleError(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return
+	}
+	select {
+	case g.errors <- err:
+	default:
+	}
+}
+
+// Errors implements ConsumerGroup.
+func (g *memGroup) Errors() <-chan error { return g.errors }
+
+// Close implements ConsumerGroup. It ends the current session.
+func (g *memGroup) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return sarama.ErrClosedConsumerGroup
+	}
+	g.closed = true
+	for _, cancel := range g.sessions {
+		cancel()
+	}
+	close(g.errors)
+	return nil
+}
+
+// memSession is a session of a memGroup. It implements sarama.ConsumerGroupSession.
+type memSession struct {
+	group      *memGroup
+	ctx        context.Context
+	generation int32
+	claims     map[string][]int32
+}
+
+func (s *memSession) Claims() map[string][]int32 { return s.claims }
+
+func (s *memSession) MemberID() string { return "memory" }
+
+func (s *memSession) GenerationID() int32 { return s.generation }
+
+// MarkOffset commits the next offset to read from a partition, unless the group committed further already.
+func (s *memSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	mb := s.group.broker
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	key := commitKey(s.group.group, topic, partition)
+	if committed, ok := mb.commits[key]; !ok || offset > committed {
+		mb.commits[key] = offset
+	}
+}
+
+// Commit does nothing: offsets are committed as they are marked.
+func (s *memSession) Commit() {}
+
+// ResetOffset commits the next offset to read from a partition, even behind the committed one.
+func (s *memSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.group.broker.Commit(s.group.group, topic, partition, offset)
+}
+
+func (s *memSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *memSession) Context() context.Context { return s.ctx }
+
+// memClaim is a partition claimed by a memSession. It implements sarama.ConsumerGroupClaim.
+type memClaim struct {
+	broker    *MemoryBroker
+	topic     string
+	partition int32
+	offset    int64 // Committed offset the claim started from, sarama.OffsetOldest if there was none.
+	consumer  PartitionConsumer
+}
+
+func (c *memClaim) Topic() string { return c.topic }
+
+func (c *memClaim) Partition() int32 { return c.partition }
+
+func (c *memClaim) InitialOffset() int64 { return c.offset }
+
+func (c *memClaim) HighWaterMarkOffset() int64 {
+	offset, _ := c.broker.NewestOffset(c.topic, c.partition)
+	return offset
+}
+
+func (c *memClaim) Messages() <-chan *sarama.ConsumerMessage { return c.consumer.Messages() }
@@ -0,0 +1,68 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// countingHandler marks every message it reads and returns from its claim after limit messages,
+// which ends the session.
+type countingHandler struct {
+	limit int
+	read  chan string
+}
+
+func (h *countingHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h *countingHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *countingHandler) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		h.read <- string(msg.Value)
+		sess.MarkMessage(msg, "")
+		if len(h.read) == h.limit {
+			return nil
+		}
+	}
+	return nil
+}
+
+// TestMemGroupResume checks a new session of a group starts after the offsets it marked.
+func TestMemGroupResume(t *testing.T) {
+	mb := NewMemoryBroker(1, 0)
+	defer mb.Close()
+
+	producer, err := mb.NewProducer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		producer.Input() <- &sarama.ProducerMessage{Topic: "t", Value: sarama.StringEncoder(fmt.Sprint(i))}
+		<-producer.Successes()
+	}
+
+	group, err := mb.NewConsumerGroup("g")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer group.Close()
+	for _, want := range [][]string{{"0", "1", "2"}, {"3", "4", "5"}} {
+		handler := &countingHandler{limit: len(want), read: make(chan string, 6)}
+		if err := group.Consume(context.Background(), []string{"t"}, handler); err != nil {
+			t.Fatal(err)
+		}
+		close(handler.read)
+		var got []string
+		for value := range handler.read {
+			got = append(got, value)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("read %v, want %v", got, want)
+		}
+	}
+	if committed, _ := mb.Committed("g", "t", 0); committed != 6 {
+		t.Errorf("committed %d, want 6", committed)
+	}
+}
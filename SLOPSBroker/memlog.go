@@ -0,0 +1,288 @@
+package broker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// MemoryBroker is an in-process partitioned log, to run SLOPS end to end without a Kafka cluster.
+// Every topic has the same number of partitions. Messages are written in the order the
+// producer receives them, so the order of the messages of a partition is deterministic.
+// A partition keeps at least its last `retention` messages; older ones are dropped
+// and consumers behind them skip ahead, as with Kafka's retention.
+type MemoryBroker struct {
+	partitions int32
+	retention  int // 0 keeps every message.
+
+	mu      sync.Mutex
+	topics  map[string][]*memPartition
+	commits map[string]int64 // Next offset by group, topic and partition.
+	closed  chan struct{}
+}
+
+type memPartition struct {
+	first    int64 // Offset of msgs[0].
+	msgs     []*sarama.ConsumerMessage
+	appended chan struct{} // Closed when a message is appended.
+}
+
+// NewMemoryBroker returns an empty log.
+func NewMemoryBroker(partitions int32, retention int) *MemoryBroker {
+	return &MemoryBroker{
+		partitions: partitions,
+		retention:  retention,
+		topics:     map[string][]*memPartition{},
+		commits:    map[string]int64{},
+		closed:     make(chan struct{}),
+	}
+}
+
+// partition returns a partition of a topic, creating the topic if needed. Callers hold the lock.
+func (mb *MemoryBroker) partition(topic string, partition int32) (*memPartition, error) {
+	if partition < 0 || partition >= mb.partitions {
+		return nil, sarama.ErrUnknownTopicOrPartition
+	}
+	parts, ok := mb.topics[topic]
+	if !ok {
+		parts = make([]*memPartition, mb.partitions)
+		for p := range parts {
+			parts[p] = &memPartition{appended: make(chan struct{})}
+		}
+		mb.topics[topic] = parts
+	}
+	return parts[partition], nil
+}
+
+// append writes a message to its partition and sets its offset.
+func (mb *MemoryBroker) append(msg *sarama.ProducerMessage) error {
+	cmsg := &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Timestamp: time.Now(),
+	}
+	var err error
+	if msg.Key != nil {
+		if cmsg.Key, err = msg.Key.Encode(); err != nil {
+			return err
+		}
+	}
+	if msg.Value != nil {
+		if cmsg.Value, err = msg.Value.Encode(); err != nil {
+			return err
+		}
+	}
+	for i := range msg.Headers {
+		cmsg.Headers = append(cmsg.Headers, &msg.Headers[i])
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	p, err := mb.partition(msg.Topic, msg.Partition)
+	if err != nil {
+		return err
+	}
+	cmsg.Offset = p.first + int64(len(p.msgs))
+	p.msgs = append(p.msgs, cmsg)
+	// Trim once the partition holds twice the retention, so appends stay cheap.
+	// Consumers may still read the old slice, which is left untouched.
+	if mb.retention > 0 && len(p.msgs) >= 2*mb.retention {
+		drop := len(p.msgs) - mb.retention
+		p.msgs = append([]*sarama.ConsumerMessage(nil), p.msgs[drop:]...)
+		p.first += int64(drop)
+	}
+	close(p.appended)
+	p.appended = make(chan struct{})
+
+	msg.Offset = cmsg.Offset
+	msg.Timestamp = cmsg.Timestamp
+	return nil
+}
+
+// NewProducer implements Broker.
+func (mb *MemoryBroker) NewProducer() (Producer, error) {
+	p := &memProducer{
+		broker:    mb,
+		input:     make(chan *sarama.ProducerMessage, 256),
+		successes: make(chan *sarama.ProducerMessage, 256),
+		errors:    make(chan *sarama.ProducerError, 256),
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// memProducer writes to a MemoryBroker.
+type memProducer struct {
+	broker    *MemoryBroker
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	done      chan struct{}
+}
+
+func (p *memProducer) run() {
+	defer close(p.done)
+	defer close(p.errors)
+	defer close(p.successes)
+
+	for msg := range p.input {
+		if err := p.broker.append(msg); err != nil {
+			p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		p.successes <- msg
+	}
+}
+
+// Input implements Producer.
+func (p *memProducer) Input() chan<- *sarama.ProducerMessage { return p.input }
+
+// Successes implements Producer.
+func (p *memProducer) Successes() <-chan *sarama.ProducerMessage { return p.successes }
+
+// Errors implements Producer.
+func (p *memProducer) Errors() <-chan *sarama.ProducerError { return p.errors }
+
+// Close implements Producer. It returns once the messages already sent to Input are written.
+func (p *memProducer) Close() error {
+	close(p.input)
+	<-p.done
+	return nil
+}
+
+// ConsumePartition implements Broker.
+func (mb *MemoryBroker) ConsumePartition(topic string, partition int32, offset int64) (PartitionConsumer, error) {
+	mb.mu.Lock()
+	_, err := mb.partition(topic, partition)
+	mb.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &memConsumer{
+		messages: make(chan *sarama.ConsumerMessage, 256),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go c.run(mb, topic, partition, offset)
+	return c, nil
+}
+
+// NewestOffset implements Broker.
+func (mb *MemoryBroker) NewestOffset(topic string, partition int32) (int64, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	p, err := mb.partition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	return p.first + int64(len(p.msgs)), nil
+}
+
+// memConsumer reads a partition of a MemoryBroker.
+type memConsumer struct {
+	messages chan *sarama.ConsumerMessage
+	closing  chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func (c *memConsumer) run(mb *MemoryBroker, topic string, partition int32, offset int64) {
+	defer close(c.done)
+	defer close(c.messages)
+
+	for {
+		mb.mu.Lock()
+		p, _ := mb.partition(topic, partition)
+		end := p.first + int64(len(p.msgs))
+		switch {
+		case offset == sarama.OffsetNewest:
+			offset = end
+		case offset == sarama.OffsetOldest || offset < p.first:
+			offset = p.first
+		case offset > end:
+			offset = end
+		}
+		batch := p.msgs[offset-p.first:]
+		appended := p.appended
+		mb.mu.Unlock()
+
+		for _, msg := range batch {
+			select {
+			case c.messages <- msg:
+				offset++
+			case <-c.closing:
+				return
+			}
+		}
+		if len(batch) > 0 {
+			continue
+		}
+		select {
+		case <-appended:
+		case <-c.closing:
+			return
+		case <-mb.closed:
+			return
+		}
+	}
+}
+
+// Messages implements PartitionConsumer.
+func (c *memConsumer) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// Close implements PartitionConsumer.
+func (c *memConsumer) Close() error {
+	c.once.Do(func() { close(c.closing) })
+	<-c.done
+	return nil
+}
+
+func commitKey(group, topic string, partition int32) string {
+	return fmt.Sprintf("%s/%s/%d", group, topic, partition)
+}
+
+// Commit implements Broker.
+func (mb *MemoryBroker) Commit(group, topic string, partition int32, offset int64) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if _, err := mb.partition(topic, partition); err != nil {
+		return err
+	}
+	mb.commits[commitKey(group, topic, partition)] = offset
+	return nil
+}
+
+// Committed implements Broker.
+func (mb *MemoryBroker) Committed(group, topic string, partition int32) (int64, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if _, err := mb.partition(topic, partition); err != nil {
+		return 0, err
+	}
+	offset, ok := mb.commits[commitKey(group, topic, partition)]
+	if !ok {
+		return sarama.OffsetOldest, nil
+	}
+	return offset, nil
+}
+
+// Close implements Broker. Consumers stop once they read what was written.
+func (mb *MemoryBroker) Close() error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	select {
+	case <-mb.closed:
+	default:
+		close(mb.closed)
+	}
+	return nil
+}
@@ -1,4 +1,4 @@
 #!/bin/bash
 go mod tidy
-docker build -t ratnadeepb/slops-consumer:latest .
+docker build -t ratnadeepb/slops-consumer:latest -f Dockerfile ..
 docker push ratnadeepb/slops-consumer:latest
\ No newline at end of file
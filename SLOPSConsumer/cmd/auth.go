@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+)
+
+// TLSConfig holds the TLS settings of the connections to the brokers.
+type TLSConfig struct {
+	Enabled            bool   // KAFKA_TLS: connect with TLS.
+	CAFile             string // KAFKA_TLS_CA_FILE: CA certificates of the brokers, the system pool if unset.
+	CertFile           string // KAFKA_TLS_CERT_FILE: client certificate, for brokers that authenticate clients.
+	KeyFile            string // KAFKA_TLS_KEY_FILE: key of the client certificate.
+	ServerName         string // KAFKA_TLS_SERVER_NAME: name checked against the broker certificates, the broker host if unset.
+	InsecureSkipVerify bool   // KAFKA_TLS_INSECURE_SKIP_VERIFY: do not verify the broker certificates.
+}
+
+// apply turns on TLS in a sarama configuration.
+func (t *TLSConfig) apply(config *sarama.Config) error {
+	if !t.Enabled {
+		return nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificate found", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	config.Net.TLS.Enable = true
+	config.Net.TLS.Config = tlsConfig
+	return nil
+}
+
+// SASLConfig holds the SASL credentials of the consumer.
+type SASLConfig struct {
+	Mechanism    string // KAFKA_SASL_MECHANISM: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, no SASL if unset.
+	Username     string // KAFKA_SASL_USERNAME, read from KAFKA_SASL_USERNAME_FILE if unset.
+	UsernameFile string // KAFKA_SASL_USERNAME_FILE: file holding the user name.
+	PasswordFile string // KAFKA_SASL_PASSWORD_FILE: file holding the password.
+}
+
+// apply turns on SASL in a sarama configuration, reading the credentials from their files.
+func (s *SASLConfig) apply(config *sarama.Config) error {
+	if s.Mechanism == "" {
+		return nil
+	}
+	user := s.Username
+	if user == "" && s.UsernameFile != "" {
+		var err error
+		if user, err = readSecret(s.UsernameFile); err != nil {
+			return err
+		}
+	}
+	if user == "" {
+		return errors.New("SASL needs KAFKA_SASL_USERNAME or KAFKA_SASL_USERNAME_FILE")
+	}
+	if s.PasswordFile == "" {
+		return errors.New("SASL needs KAFKA_SASL_PASSWORD_FILE")
+	}
+	password, err := readSecret(s.PasswordFile)
+	if err != nil {
+		return err
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	// Brokers since Kafka 1.0 take the credentials in framed SaslAuthenticate requests.
+	if config.Version.IsAtLeast(sarama.V1_0_0_0) {
+		config.Net.SASL.Version = sarama.SASLHandshakeV1
+	}
+	config.Net.SASL.User = user
+	config.Net.SASL.Password = password
+	switch s.Mechanism {
+	case "PLAIN":
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case "SCRAM-SHA-256":
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA256}
+		}
+	case "SCRAM-SHA-512":
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("invalid KAFKA_SASL_MECHANISM %q", s.Mechanism)
+	}
+	return nil
+}
+
+// readSecret reads a credential from a file, such as a mounted Kubernetes secret.
+// A trailing newline is not part of the credential.
+func readSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// scramClient implements sarama.SCRAMClient.
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+	conv *scram.ClientConversation
+}
+
+// Begin implements sarama.SCRAMClient.
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conv = client.NewConversation()
+	return nil
+}
+
+// Step implements sarama.SCRAMClient.
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+// Done implements sarama.SCRAMClient.
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// Config holds the settings of the consumer, read from the environment.
+type Config struct {
+	Brokers         []string // KAFKA_BOOTSTRAP: comma separated bootstrap brokers.
+	Topic           string   // KAFKA_TOPIC (Default OrderGo).
+	Group           string   // KAFKA_GROUP: consumer group (Default OrderGroup).
+	ClientID        string   // KAFKA_CLIENT_ID (Default ADDRESS).
+	Version         string   // KAFKA_VERSION: Kafka version the consumer speaks, sarama's default if unset.
+	InitialOffset   string   // KAFKA_INITIAL_OFFSET: oldest or newest, where a group without committed offsets starts (Default oldest).
+	BalanceStrategy string   // KAFKA_BALANCE_STRATEGY: sticky, range or roundrobin (Default sticky).
+	TLS             TLSConfig
+	SASL            SASLConfig
+
+	SvcTime        int // SVC_TIME_MS: simulated service time of a message.
+	ReorderTimeout int // REORDER_TIMEOUT_MS: release held messages after this long (Default 5000).
+	SyncPort       int // SYNC_PORT: port of the consumer sync API (Default 8080).
+}
+
+// LoadConfig reads the configuration from the environment and checks it.
+func LoadConfig() (*Config, error) {
+	c := &Config{
+		Topic:           envOr("KAFKA_TOPIC", "OrderGo"),
+		Group:           envOr("KAFKA_GROUP", "OrderGroup"),
+		ClientID:        envOr("KAFKA_CLIENT_ID", os.Getenv("ADDRESS")),
+		Version:         os.Getenv("KAFKA_VERSION"),
+		InitialOffset:   envOr("KAFKA_INITIAL_OFFSET", "oldest"),
+		BalanceStrategy: envOr("KAFKA_BALANCE_STRATEGY", "sticky"),
+		TLS: TLSConfig{
+			CAFile:     os.Getenv("KAFKA_TLS_CA_FILE"),
+			CertFile:   os.Getenv("KAFKA_TLS_CERT_FILE"),
+			KeyFile:    os.Getenv("KAFKA_TLS_KEY_FILE"),
+			ServerName: os.Getenv("KAFKA_TLS_SERVER_NAME"),
+		},
+		SASL: SASLConfig{
+			Mechanism:    os.Getenv("KAFKA_SASL_MECHANISM"),
+			Username:     os.Getenv("KAFKA_SASL_USERNAME"),
+			UsernameFile: os.Getenv("KAFKA_SASL_USERNAME_FILE"),
+			PasswordFile: os.Getenv("KAFKA_SASL_PASSWORD_FILE"),
+		},
+	}
+	c.TLS.Enabled, _ = strconv.ParseBool(os.Getenv("KAFKA_TLS"))
+	c.TLS.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv("KAFKA_TLS_INSECURE_SKIP_VERIFY"))
+	for _, broker := range strings.Split(os.Getenv("KAFKA_BOOTSTRAP"), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			c.Brokers = append(c.Brokers, broker)
+		}
+	}
+	if len(c.Brokers) == 0 {
+		return nil, errors.New("KAFKA_BOOTSTRAP is not set")
+	}
+
+	var err error
+	if c.SvcTime, err = strconv.Atoi(os.Getenv("SVC_TIME_MS")); err != nil || c.SvcTime < 0 {
+		return nil, errors.New("Service Time not defined")
+	}
+	if c.ReorderTimeout, err = envInt("REORDER_TIMEOUT_MS", 5000); err != nil {
+		return nil, err
+	}
+	if c.SyncPort, err = envInt("SYNC_PORT", 8080); err != nil {
+		return nil, err
+	}
+	if _, err := c.Sarama(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// envOr returns an environment variable, or `def` if it is not set.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt returns a positive integer from the environment, or `def` if it is not set.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// Sarama returns the sarama configuration of the consumer group.
+func (c *Config) Sarama() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	if c.Version != "" {
+		version, err := sarama.ParseKafkaVersion(c.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+	if c.ClientID != "" {
+		config.ClientID = c.ClientID
+	}
+
+	switch c.InitialOffset {
+	case "oldest":
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	case "newest":
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_INITIAL_OFFSET %q", c.InitialOffset)
+	}
+	switch c.BalanceStrategy {
+	case "sticky":
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategySticky}
+	case "range":
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategyRange}
+	case "roundrobin":
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategyRoundRobin}
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_BALANCE_STRATEGY %q", c.BalanceStrategy)
+	}
+	if err := c.TLS.apply(config); err != nil {
+		return nil, err
+	}
+	if err := c.SASL.apply(config); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -8,50 +8,25 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	broker "github.com/MSrvComm/SLOPSBroker"
 	"github.com/Shopify/sarama"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/Shopify/sarama/otelsarama"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/exporters/jaeger"
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	_ "go.uber.org/automaxprocs"
 )
 
-const (
-	topic = "OrderGo"
-	group = "OrderGroup"
-)
-
-func TracerProvider() (*sdktrace.TracerProvider, error) {
-	url := os.Getenv("TRACER_COLLECTOR")
-	// Create Jaeger exporter.
-	exp, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(url)))
+func main() {
+	conf, err := LoadConfig()
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	svcName := os.Getenv("TRACER_NAME")
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(svcName),
-			attribute.String("exporter", "jaeger"),
-		)),
-	)
-	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}))
-	return tp, nil
-}
 
-func main() {
 	tp, tperr := TracerProvider()
 
 	if tperr != nil {
@@ -73,20 +48,42 @@ func main() {
 	keepRunning := true
 	// sarama logging to stdout.
 	sarama.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Llongfile)
-	// consumer config
-	config := sarama.NewConfig()
-	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.BalanceStrategySticky}
-	config.Consumer.Offsets.Initial = sarama.OffsetOldest
-	config.ClientID = os.Getenv("ADDRESS")
+	// consumer config, validated by LoadConfig.
+	config, err := conf.Sarama()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	kafkaConn := os.Getenv("KAFKA_BOOTSTRAP")
+	// Messages of a migrated key are held here until the previous message set has ended.
+	buffer := NewReorderBuffer(time.Duration(conf.ReorderTimeout) * time.Millisecond)
+	syncer := NewSyncer(buffer, os.Getenv("ADDRESS"), conf.SyncPort, os.Getenv("SYNC_PEERS"), os.Getenv("SYNC_DISCOVERY"))
+	go syncer.Run()
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for now := range ticker.C {
+			buffer.Expire(now)
+		}
+	}()
 
-	consumer := Consumer{ready: make(chan bool)}
+	ip := os.Getenv("ADDRESS")
+	consumer := Consumer{
+		ready:  make(chan bool),
+		buffer: buffer,
+		handle: func(msg *sarama.ConsumerMessage) {
+			printMessage(msg, conf.SvcTime, ip)
+		},
+	}
 	propagators := propagation.TraceContext{}
 
 	handler := otelsarama.WrapConsumerGroupHandler(&consumer, otelsarama.WithPropagators(propagators))
 
-	client, err := sarama.NewConsumerGroup([]string{kafkaConn}, group, config)
+	// The messages are read through the broker the producer writes to.
+	kafka, err := broker.NewKafkaBroker(conf.Brokers, config)
+	if err != nil {
+		log.Panicf("Error creating Kafka client: %v", err)
+	}
+	defer kafka.Close()
+	client, err := kafka.NewConsumerGroup(conf.Group)
 	if err != nil {
 		log.Panicf("Error creating consumer group client: %v", err)
 	}
@@ -99,7 +96,7 @@ func main() {
 			// `Consume` should be called inside an infinite loop, when a
 			// server-side rebalance happens, the consumer session will need to be
 			// recreated to get the new claims
-			if err := client.Consume(ctx, []string{topic}, handler); err != nil {
+			if err := client.Consume(ctx, []string{conf.Topic}, handler); err != nil {
 				log.Panicf("Error from consumer: %v", err)
 			}
 
@@ -136,7 +133,9 @@ func main() {
 }
 
 type Consumer struct {
-	ready chan bool
+	ready  chan bool
+	buffer *ReorderBuffer                // Shared by the claims of every partition.
+	handle func(*sarama.ConsumerMessage) // Processes a message once its turn has come.
 }
 
 // Setup is run at the beginning of a new session, before ConsumeClaim
@@ -153,13 +152,8 @@ func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
 
 // ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
 func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	containerIP := os.Getenv("ADDRESS")
-
-	// env vars
-	svcTm, err := strconv.Atoi(os.Getenv("SVC_TIME_MS"))
-	if err != nil {
-		log.Fatal("Service Time not defined")
-	}
+	released := consumer.buffer.Register(claim.Partition())
+	defer consumer.buffer.Unregister(claim.Partition())
 
 	// NOTE:
 	// Do not move the code below to a goroutine.
@@ -167,10 +161,30 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	// https://github.com/Shopify/sarama/blob/main/consumer_group.go#L27-L29
 	for {
 		select {
-		case message := <-claim.Messages():
-			printMessage(message, svcTm, containerIP)
-			// Commit message
-			session.MarkMessage(message, "")
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			msgset, err := decodeMsgset(message)
+			if err != nil {
+				log.Println("Decoding err:", err)
+			}
+			if msgset != nil && msgset.SrcPartition > -1 && msgset.SrcMsgsetIndex > -1 &&
+				message.Partition == msgset.DestPartition {
+				HandleSyncEvent(*msgset)
+				// The producer held this message until the previous set was complete.
+				if drained(message) {
+					consumer.HandleShiftKey(string(message.Key), msgset.SrcMsgsetIndex)
+				}
+			}
+			// Hold the message if the previous message set of its key has not ended yet.
+			if consumer.buffer.Submit(message, msgset) {
+				consumer.process(session, message, msgset)
+			}
+		case <-released:
+			for _, hm := range consumer.buffer.Released(claim.Partition()) {
+				consumer.process(session, hm.msg, hm.msgset)
+			}
 		// Should return when `session.Context()` is done.
 		// If not, will raise `ErrRebalanceInProgress` or `read tcp <ip>:<port>: i/o timeout` when kafka rebalance. see:
 		// https://github.com/Shopify/sarama/issues/1192
@@ -180,6 +194,70 @@ func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, clai
 	}
 }
 
+// process handles a message whose turn has come and commits as far as the buffer allows.
+func (consumer *Consumer) process(session sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage, msgset *MessageSet) {
+	// Control records only end a message set.
+	if !isControl(msg) {
+		consumer.handle(msg)
+	}
+	if msgset != nil {
+		// Check if this is the last message of a set.
+		if set, ends := msgsetPosition(msg, msgset); ends {
+			consumer.HandleShiftKey(string(msg.Key), set)
+		}
+	}
+	// Commit message
+	session.MarkOffset(msg.Topic, msg.Partition, consumer.buffer.Done(msg, msgset), "")
+}
+
+// decodeMsgset extracts the message set header of a message.
+// It returns nil when the message does not carry one.
+func decodeMsgset(msg *sarama.ConsumerMessage) (*MessageSet, error) {
+	for _, hdr := range msg.Headers {
+		if string(hdr.Key) == "SyncEvent" {
+			dec := gob.NewDecoder(bytes.NewBuffer(hdr.Value))
+			var msgset MessageSet
+			if err := dec.Decode(&msgset); err != nil {
+				return nil, err
+			}
+			return &msgset, nil
+		}
+	}
+	return nil, nil
+}
+
+// drained reports whether a message starts a message set after the producer drained the previous one.
+func drained(msg *sarama.ConsumerMessage) bool {
+	for _, hdr := range msg.Headers {
+		if string(hdr.Key) == "MsgsetDrained" {
+			return true
+		}
+	}
+	return false
+}
+
+// startsSet reports whether a message is the first of its message set.
+// Producers older than the `MsgsetStart` header never mark it, so their sets are not held:
+// producers are upgraded before consumers.
+func startsSet(msg *sarama.ConsumerMessage) bool {
+	for _, hdr := range msg.Headers {
+		if string(hdr.Key) == "MsgsetStart" {
+			return true
+		}
+	}
+	return false
+}
+
+// isControl reports whether a record is a control record of the producer rather than a message.
+func isControl(msg *sarama.ConsumerMessage) bool {
+	for _, hdr := range msg.Headers {
+		if string(hdr.Key) == "Control" {
+			return true
+		}
+	}
+	return false
+}
+
 func printMessage(msg *sarama.ConsumerMessage, svcTm int, ip string) {
 	// Extract tracing info from message
 	propagators := propagation.TraceContext{}
@@ -215,25 +293,6 @@ func printMessage(msg *sarama.ConsumerMessage, svcTm int, ip string) {
 			log.Println("Arrived from producer:", string(hdr.Value))
 			sendingGateway = string(hdr.Value)
 		}
-
-		// Detect and Handle sync events.
-		if string(hdr.Key) == "SyncEvent" {
-			dec := gob.NewDecoder(bytes.NewBuffer(hdr.Value))
-			var msgset MessageSet
-			err := dec.Decode(&msgset)
-			if err != nil {
-				log.Println("Decoding err:", err)
-				return
-			}
-			// Check if this is the last message of a set.
-			if msgset.DestPartition != msg.Partition {
-				HandleShiftKey(key)
-			}
-			// Ignore new streams.
-			if msgset.SrcPartition > -1 && msgset.SrcMsgsetIndex > -1 {
-				HandleSyncEvent(msgset)
-			}
-		}
 	}
 
 	time.Sleep(time.Millisecond * time.Duration(svcTm))
@@ -253,8 +312,11 @@ func printMessage(msg *sarama.ConsumerMessage, svcTm int, ip string) {
 // Handle key shift events.
 // This basically means that a consumer is being told that a stream (key)
 // has started a new message set on a different partition.
-func HandleShiftKey(key string) {
+// The end of the old set releases the messages of the new set,
+// here and in the other consumer instances.
+func (consumer *Consumer) HandleShiftKey(key string, set int32) {
 	log.Println("Handling Shift Key event for:", key)
+	consumer.buffer.EndSet(key, set)
 }
 
 // Handle sync events.
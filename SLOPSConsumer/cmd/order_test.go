@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	broker "github.com/MSrvComm/SLOPSBroker"
+	"github.com/Shopify/sarama"
+)
+
+const testTopic = "OrderGo"
+
+// logWriter writes messages to the in-process log like the producer does with the reorder
+// strategy: a key switching partition starts a new message set, whose first message carries
+// the MsgsetStart header, and a control record ends the previous set on the old partition.
+type logWriter struct {
+	t        *testing.T
+	producer broker.Producer
+	sets     map[string]*MessageSet
+	sent     map[string][]string // Values written for each key, in order.
+}
+
+func newLogWriter(t *testing.T, mb *broker.MemoryBroker) *logWriter {
+	producer, err := mb.NewProducer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &logWriter{t: t, producer: producer, sets: map[string]*MessageSet{}, sent: map[string][]string{}}
+}
+
+// write hands a record to the log and waits for it to be written.
+func (w *logWriter) write(msg *sarama.ProducerMessage) {
+	w.t.Helper()
+	w.producer.Input() <- msg
+	select {
+	case <-w.producer.Successes():
+	case perr := <-w.producer.Errors():
+		w.t.Fatal(perr.Err)
+	}
+}
+
+// send writes the next message of a key to a partition.
+func (w *logWriter) send(key string, partition int32) {
+	w.t.Helper()
+	last, ok := w.sets[key]
+	starts := !ok || last.DestPartition != partition
+	msgset := &MessageSet{Key: key, SrcPartition: -1, SrcMsgsetIndex: -1, DestPartition: partition}
+	if ok && starts {
+		msgset = &MessageSet{
+			Key:             key,
+			SrcPartition:    last.DestPartition,
+			SrcMsgsetIndex:  last.DestMsgsetIndex,
+			DestPartition:   partition,
+			DestMsgsetIndex: last.DestMsgsetIndex + 1,
+		}
+	} else if ok {
+		msgset = last
+	}
+	w.sets[key] = msgset
+
+	var header bytes.Buffer
+	if err := gob.NewEncoder(&header).Encode(msgset); err != nil {
+		w.t.Fatal(err)
+	}
+	value := fmt.Sprintf("%s-%d", key, len(w.sent[key]))
+	w.sent[key] = append(w.sent[key], value)
+	headers := []sarama.RecordHeader{{Key: []byte("SyncEvent"), Value: header.Bytes()}}
+	if starts {
+		headers = append(headers, sarama.RecordHeader{Key: []byte("MsgsetStart"), Value: []byte("true")})
+	}
+	w.write(&sarama.ProducerMessage{
+		Topic:     testTopic,
+		Key:       sarama.StringEncoder(key),
+		Value:     sarama.StringEncoder(value),
+		Headers:   headers,
+		Partition: partition,
+	})
+	if ok && starts {
+		w.write(&sarama.ProducerMessage{
+			Topic: testTopic,
+			Key:   sarama.StringEncoder(key),
+			Headers: []sarama.RecordHeader{
+				{Key: []byte("SyncEvent"), Value: header.Bytes()},
+				{Key: []byte("Control"), Value: []byte("EndOfSet")},
+			},
+			Partition: msgset.SrcPartition,
+		})
+	}
+}
+
+// TestConsumerOrder reads what a producer wrote to the in-process log through a consumer group
+// and checks every key is processed in the order it was sent, across its migrations.
+// Messages of the slow partition take longer, so the claims of the other partitions run ahead.
+func TestConsumerOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string][]int32 // Partition of each message of a key.
+		slow   int32
+	}{
+		{
+			name:   "one migration",
+			routes: map[string][]int32{"a": {0, 0, 0, 0, 1, 1, 1, 1}},
+			slow:   0,
+		},
+		{
+			name:   "back and forth",
+			routes: map[string][]int32{"a": {0, 0, 1, 1, 0, 0, 1, 1, 2, 2}},
+			slow:   0,
+		},
+		{
+			name: "many keys",
+			routes: map[string][]int32{
+				"a": {0, 0, 0, 1, 1, 2, 2, 2},
+				"b": {1, 1, 0, 0, 0, 0, 1, 1},
+				"c": {2, 2, 2, 2, 2, 2, 2, 2},
+				"d": {2, 1, 0, 2, 1, 0, 2, 1},
+			},
+			slow: 2,
+		},
+		{
+			name:   "new set on the slow partition",
+			routes: map[string][]int32{"a": {1, 1, 1, 0, 0, 0, 1, 1}},
+			slow:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mb := broker.NewMemoryBroker(3, 0)
+			defer mb.Close()
+
+			// The keys are written in turns, one message each.
+			w := newLogWriter(t, mb)
+			keys := make([]string, 0, len(tt.routes))
+			for key := range tt.routes {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for i := 0; ; i++ {
+				more := false
+				for _, key := range keys {
+					if i < len(tt.routes[key]) {
+						w.send(key, tt.routes[key][i])
+						more = true
+					}
+				}
+				if !more {
+					break
+				}
+			}
+
+			var mu sync.Mutex
+			processed := map[string][]string{}
+			consumer := &Consumer{
+				ready:  make(chan bool),
+				buffer: NewReorderBuffer(time.Minute), // Nothing is released by the timeout.
+				handle: func(msg *sarama.ConsumerMessage) {
+					if msg.Partition == tt.slow {
+						time.Sleep(2 * time.Millisecond)
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					processed[string(msg.Key)] = append(processed[string(msg.Key)], string(msg.Value))
+				},
+			}
+			group, err := mb.NewConsumerGroup("OrderGroup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer group.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			consumed := make(chan error, 1)
+			go func() {
+				consumed <- group.Consume(ctx, []string{testTopic}, consumer)
+			}()
+
+			// Every record, control records included, is committed once processed.
+			deadline := time.Now().Add(10 * time.Second)
+			for p := int32(0); p < 3; p++ {
+				end, err := mb.NewestOffset(testTopic, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for end > 0 {
+					committed, err := mb.Committed("OrderGroup", testTopic, p)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if committed >= end {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("partition %d committed up to %d of %d", p, committed, end)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+			cancel()
+			if err := <-consumed; err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range keys {
+				got, want := processed[key], w.sent[key]
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Errorf("key %s processed %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// heldMessage is a message that arrived before the message set preceding its own had ended.
+type heldMessage struct {
+	msg      *sarama.ConsumerMessage
+	msgset   *MessageSet
+	set      int32     // The message set this message belongs to.
+	start    bool      // First message of its set.
+	released bool      // Handed to the partition's claim but not processed yet.
+	since    time.Time // When the message was held.
+}
+
+// partitionState tracks the messages of a claimed partition that sit in the buffer.
+type partitionState struct {
+	signal   chan struct{}      // Wakes up the partition's claim when messages are released.
+	released []*heldMessage     // Released messages waiting to be processed, in order.
+	pending  map[int64]struct{} // Offsets of messages still in the buffer.
+	highest  int64              // Highest processed offset.
+	starts   map[int64]setStart // Processed first messages of a set whose offset is not committed yet.
+}
+
+// setStart is the first message of message set `set` of a key.
+type setStart struct {
+	key string
+	set int32
+}
+
+// endedSet is the highest message set of a key known to have ended.
+type endedSet struct {
+	set int32
+	at  time.Time // When it was recorded.
+}
+
+// ReorderBuffer holds messages of a key whose message set n has started
+// on one partition until set n-1 has been seen to end on its source partition.
+// It is shared by the `ConsumeClaim` goroutines of every partition in the process,
+// and is told about sets ending in other consumer instances through the `Syncer`.
+//
+// Only the first message of a set waits for the previous set: the others follow it on
+// the same partition. The end of set n-1 is therefore forgotten once the first message
+// of set n is committed, or `retention` after it ended if that message is not consumed here.
+type ReorderBuffer struct {
+	mu        sync.Mutex
+	timeout   time.Duration                       // Release held messages after this long even if their previous set never ended.
+	retention time.Duration                       // Forget an ended set this long after it ended.
+	ended     map[string]endedSet                 // Highest message set known to have ended, per key.
+	queues    map[string]map[int32][]*heldMessage // Per key, per partition FIFO of buffered messages.
+	parts     map[int32]*partitionState           // Partitions currently claimed by this process.
+	onEnd     func(key string, set int32)         // Called when this process sees a set end.
+}
+
+// endedRetention is how many reorder timeouts an ended set is remembered for
+// when the first message of the next set is not consumed by this process.
+const endedRetention = 10
+
+// NewReorderBuffer returns an empty buffer.
+func NewReorderBuffer(timeout time.Duration) *ReorderBuffer {
+	return &ReorderBuffer{
+		timeout:   timeout,
+		retention: endedRetention * timeout,
+		ended:     map[string]endedSet{},
+		queues:    map[string]map[int32][]*heldMessage{},
+		parts:     map[int32]*partitionState{},
+	}
+}
+
+// msgsetPosition returns the message set a message belongs to and
+// whether processing it ends that set.
+// A message on its destination partition belongs to the destination set.
+// A record on the source partition, the control record that ends the source set,
+// is the last of the source set.
+func msgsetPosition(msg *sarama.ConsumerMessage, msgset *MessageSet) (int32, bool) {
+	if msg.Partition == msgset.DestPartition {
+		return msgset.DestMsgsetIndex, false
+	}
+	return msgset.SrcMsgsetIndex, true
+}
+
+// Register starts tracking a claimed partition.
+// The returned channel is signalled when held messages of the partition are released.
+func (rb *ReorderBuffer) Register(partition int32) <-chan struct{} {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	ps := &partitionState{
+		signal:  make(chan struct{}, 1),
+		pending: map[int64]struct{}{},
+		highest: -1,
+		starts:  map[int64]setStart{},
+	}
+	rb.parts[partition] = ps
+	return ps.signal
+}
+
+// Unregister drops every buffered message of a partition that is no longer claimed.
+// The new owner will receive them again from the last committed offset.
+func (rb *ReorderBuffer) Unregister(partition int32) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for key, byPart := range rb.queues {
+		delete(byPart, partition)
+		if len(byPart) == 0 {
+			delete(rb.queues, key)
+		}
+	}
+	delete(rb.parts, partition)
+}
+
+// Submit decides whether a message can be processed right away.
+// If not, the message is buffered and returned later through `Released`.
+func (rb *ReorderBuffer) Submit(msg *sarama.ConsumerMessage, msgset *MessageSet) bool {
+	if msgset == nil {
+		// Not part of the message set protocol.
+		return true
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	key := string(msg.Key)
+	set, _ := msgsetPosition(msg, msgset)
+	start := startsSet(msg)
+	q := rb.queues[key][msg.Partition]
+	if len(q) == 0 && rb.ready(key, set, start) {
+		return true
+	}
+
+	ps, ok := rb.parts[msg.Partition]
+	if !ok {
+		// The partition was revoked while the message was in flight.
+		return false
+	}
+	if rb.queues[key] == nil {
+		rb.queues[key] = map[int32][]*heldMessage{}
+	}
+	rb.queues[key][msg.Partition] = append(q, &heldMessage{
+		msg:    msg,
+		msgset: msgset,
+		set:    set,
+		start:  start,
+		since:  time.Now(),
+	})
+	ps.pending[msg.Offset] = struct{}{}
+	rb.release(key)
+	return false
+}
+
+// Released returns the messages of a partition that are now ready, in order.
+func (rb *ReorderBuffer) Released(partition int32) []*heldMessage {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	ps, ok := rb.parts[partition]
+	if !ok {
+		return nil
+	}
+	released := ps.released
+	ps.released = nil
+	return released
+}
+
+// Done records that a message has been processed and returns the offset
+// that can safely be committed for its partition.
+// The offset never moves past a message that is still buffered.
+// Once the first message of a set is committed, the end of the previous set is forgotten.
+func (rb *ReorderBuffer) Done(msg *sarama.ConsumerMessage, msgset *MessageSet) int64 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	key := string(msg.Key)
+	if q := rb.queues[key][msg.Partition]; len(q) > 0 && q[0].msg.Offset == msg.Offset {
+		if len(q) == 1 {
+			delete(rb.queues[key], msg.Partition)
+			if len(rb.queues[key]) == 0 {
+				delete(rb.queues, key)
+			}
+		} else {
+			rb.queues[key][msg.Partition] = q[1:]
+		}
+	}
+
+	ps, ok := rb.parts[msg.Partition]
+	if !ok {
+		return msg.Offset + 1
+	}
+	delete(ps.pending, msg.Offset)
+	if msg.Offset > ps.highest {
+		ps.highest = msg.Offset
+	}
+	commit := ps.highest + 1
+	for offset := range ps.pending {
+		if offset < commit {
+			commit = offset
+		}
+	}
+	if msgset != nil && startsSet(msg) {
+		set, _ := msgsetPosition(msg, msgset)
+		ps.starts[msg.Offset] = setStart{key: key, set: set}
+	}
+	for offset, s := range ps.starts {
+		if offset < commit {
+			delete(ps.starts, offset)
+			rb.forget(s.key, s.set-1)
+		}
+	}
+	return commit
+}
+
+// EndSet records that this process has seen message set `set` of a key end
+// and releases the messages that were waiting for it.
+func (rb *ReorderBuffer) EndSet(key string, set int32) {
+	rb.Advance(key, set)
+	if rb.onEnd != nil {
+		rb.onEnd(key, set)
+	}
+}
+
+// Advance records that message set `set` of a key has ended somewhere
+// and releases the messages that were waiting for it.
+func (rb *ReorderBuffer) Advance(key string, set int32) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.advance(key, set)
+	rb.release(key)
+}
+
+// Ended returns a copy of the highest ended message set of every key.
+func (rb *ReorderBuffer) Ended() map[string]int32 {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	ended := make(map[string]int32, len(rb.ended))
+	for key, e := range rb.ended {
+		ended[key] = e.set
+	}
+	return ended
+}
+
+// Expire releases messages that have been held longer than the timeout.
+// This keeps a key moving when the end of its previous set was lost.
+// It also forgets the ended sets older than the retention that no buffered message waits for.
+func (rb *ReorderBuffer) Expire(now time.Time) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for key, byPart := range rb.queues {
+		for _, q := range byPart {
+			for _, hm := range q {
+				if hm.released {
+					continue
+				}
+				if now.Sub(hm.since) >= rb.timeout {
+					log.Printf("Reorder timeout: releasing key %s message set %d without the end of set %d\n",
+						key, hm.set, hm.set-1)
+					rb.advance(key, hm.set-1)
+				}
+				break
+			}
+		}
+		rb.release(key)
+	}
+	for key, e := range rb.ended {
+		if _, held := rb.queues[key]; !held && now.Sub(e.at) >= rb.retention {
+			delete(rb.ended, key)
+		}
+	}
+}
+
+// advance raises the ended set of a key. Callers hold the lock.
+func (rb *ReorderBuffer) advance(key string, set int32) {
+	if cur, ok := rb.ended[key]; !ok || set > cur.set {
+		rb.ended[key] = endedSet{set: set, at: time.Now()}
+	}
+}
+
+// forget drops the end of set `set` of a key once nothing waits for it. Callers hold the lock.
+func (rb *ReorderBuffer) forget(key string, set int32) {
+	if cur, ok := rb.ended[key]; ok && cur.set == set {
+		delete(rb.ended, key)
+	}
+}
+
+// ready reports whether a message of set `set` can be processed. Callers hold the lock.
+// The first message of a set waits until every set before it has ended. The messages
+// after it on the same partition follow it, so they never wait.
+func (rb *ReorderBuffer) ready(key string, set int32, start bool) bool {
+	if set <= 0 || !start {
+		return true
+	}
+	ended, ok := rb.ended[key]
+	return ok && ended.set >= set-1
+}
+
+// release hands over the ready messages at the front of each of the key's queues.
+// Callers hold the lock.
+func (rb *ReorderBuffer) release(key string) {
+	for partition, q := range rb.queues[key] {
+		ps, ok := rb.parts[partition]
+		if !ok {
+			continue
+		}
+		releasedAny := false
+		for _, hm := range q {
+			if hm.released {
+				continue
+			}
+			if !rb.ready(key, hm.set, hm.start) {
+				break
+			}
+			hm.released = true
+			ps.released = append(ps.released, hm)
+			releasedAny = true
+		}
+		if releasedAny {
+			select {
+			case ps.signal <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
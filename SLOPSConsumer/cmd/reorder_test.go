@@ -0,0 +1,196 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// step is a record read by a claim in a ReorderBuffer test.
+type step struct {
+	partition int32
+	offset    int64
+	set       int32 // DestMsgsetIndex, the source set is set-1.
+	src, dest int32
+	start     bool
+	end       bool // A control record ending set-1 on src.
+}
+
+func (s step) message() (*sarama.ConsumerMessage, *MessageSet) {
+	msg := &sarama.ConsumerMessage{Key: []byte("k"), Partition: s.partition, Offset: s.offset}
+	if s.start {
+		msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: []byte("MsgsetStart"), Value: []byte("true")})
+	}
+	if s.end {
+		msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: []byte("Control"), Value: []byte("EndOfSet")})
+	}
+	return msg, &MessageSet{
+		Key:             "k",
+		SrcPartition:    s.src,
+		SrcMsgsetIndex:  s.set - 1,
+		DestPartition:   s.dest,
+		DestMsgsetIndex: s.set,
+	}
+}
+
+// run submits the steps in order, processes what the buffer lets through and
+// returns the processed records as partition/offset pairs.
+func run(t *testing.T, rb *ReorderBuffer, steps []step) [][2]int64 {
+	t.Helper()
+
+	var processed [][2]int64
+	process := func(msg *sarama.ConsumerMessage, msgset *MessageSet) {
+		processed = append(processed, [2]int64{int64(msg.Partition), msg.Offset})
+		if set, ends := msgsetPosition(msg, msgset); ends {
+			rb.Advance(string(msg.Key), set)
+		}
+		rb.Done(msg, msgset)
+	}
+	for _, s := range steps {
+		msg, msgset := s.message()
+		if rb.Submit(msg, msgset) {
+			process(msg, msgset)
+		}
+		for p := range rb.parts {
+			for _, hm := range rb.Released(p) {
+				process(hm.msg, hm.msgset)
+			}
+		}
+	}
+	return processed
+}
+
+func TestReorderBuffer(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+		want  [][2]int64
+	}{
+		{
+			name: "set 0 is never held",
+			steps: []step{
+				{partition: 0, offset: 0, set: 0, src: -1, dest: 0},
+				{partition: 0, offset: 1, set: 0, src: -1, dest: 0},
+			},
+			want: [][2]int64{{0, 0}, {0, 1}},
+		},
+		{
+			name: "end before the new set",
+			steps: []step{
+				{partition: 0, offset: 0, set: 0, src: -1, dest: 0},
+				{partition: 0, offset: 1, set: 1, src: 0, dest: 1, end: true},
+				{partition: 1, offset: 0, set: 1, src: 0, dest: 1, start: true},
+				{partition: 1, offset: 1, set: 1, src: 0, dest: 1},
+			},
+			want: [][2]int64{{0, 0}, {0, 1}, {1, 0}, {1, 1}},
+		},
+		{
+			name: "new set held until the end",
+			steps: []step{
+				{partition: 1, offset: 0, set: 1, src: 0, dest: 1, start: true},
+				{partition: 1, offset: 1, set: 1, src: 0, dest: 1},
+				{partition: 0, offset: 0, set: 0, src: -1, dest: 0},
+				{partition: 0, offset: 1, set: 1, src: 0, dest: 1, end: true},
+				{partition: 1, offset: 2, set: 1, src: 0, dest: 1},
+			},
+			want: [][2]int64{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {1, 2}},
+		},
+		{
+			name: "two migrations",
+			steps: []step{
+				{partition: 2, offset: 0, set: 2, src: 1, dest: 2, start: true},
+				{partition: 1, offset: 0, set: 1, src: 0, dest: 1, start: true},
+				{partition: 0, offset: 0, set: 1, src: 0, dest: 1, end: true},
+				{partition: 1, offset: 1, set: 2, src: 1, dest: 2, end: true},
+				{partition: 2, offset: 1, set: 2, src: 1, dest: 2},
+			},
+			want: [][2]int64{{0, 0}, {1, 0}, {1, 1}, {2, 0}, {2, 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := NewReorderBuffer(time.Minute)
+			for p := int32(0); p < 3; p++ {
+				rb.Register(p)
+			}
+			got := run(t, rb, tt.steps)
+			if len(got) != len(tt.want) {
+				t.Fatalf("processed %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("processed %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReorderBufferCommit(t *testing.T) {
+	rb := NewReorderBuffer(time.Minute)
+	rb.Register(0)
+	rb.Register(1)
+
+	held, heldSet := step{partition: 1, offset: 0, set: 1, src: 0, dest: 1, start: true}.message()
+	if rb.Submit(held, heldSet) {
+		t.Fatal("first message of set 1 processed before the end of set 0")
+	}
+	// A message of another key on the same partition is processed, but the offset
+	// cannot be committed past the held one.
+	other := &sarama.ConsumerMessage{Key: []byte("other"), Partition: 1, Offset: 1}
+	if !rb.Submit(other, nil) {
+		t.Fatal("message outside the protocol held")
+	}
+	if commit := rb.Done(other, nil); commit != 0 {
+		t.Fatalf("committed up to %d past a held message", commit)
+	}
+
+	rb.EndSet("k", 0)
+	released := rb.Released(1)
+	if len(released) != 1 || released[0].msg != held {
+		t.Fatalf("released %v, want the held message", released)
+	}
+	if commit := rb.Done(held, heldSet); commit != 2 {
+		t.Fatalf("committed up to %d, want 2", commit)
+	}
+	if _, ok := rb.Ended()["k"]; ok {
+		t.Fatal("end of set 0 kept after the first message of set 1 was committed")
+	}
+
+	// The rest of set 1 follows its first message.
+	next, nextSet := step{partition: 1, offset: 2, set: 1, src: 0, dest: 1}.message()
+	if !rb.Submit(next, nextSet) {
+		t.Fatal("second message of set 1 held after the end of set 0 was forgotten")
+	}
+}
+
+func TestReorderBufferExpire(t *testing.T) {
+	rb := NewReorderBuffer(time.Second)
+	rb.Register(1)
+
+	msg, msgset := step{partition: 1, offset: 0, set: 1, src: 0, dest: 1, start: true}.message()
+	if rb.Submit(msg, msgset) {
+		t.Fatal("first message of set 1 processed before the end of set 0")
+	}
+	now := time.Now()
+	rb.Expire(now)
+	if len(rb.Released(1)) != 0 {
+		t.Fatal("released before the reorder timeout")
+	}
+	rb.Expire(now.Add(time.Second))
+	if len(rb.Released(1)) != 1 {
+		t.Fatal("not released after the reorder timeout")
+	}
+
+	// An end whose next set is consumed elsewhere is forgotten after the retention.
+	rb.Advance("elsewhere", 3)
+	rb.Expire(now.Add(2 * time.Second))
+	if _, ok := rb.Ended()["elsewhere"]; !ok {
+		t.Fatal("ended set forgotten before the retention")
+	}
+	rb.Expire(now.Add(endedRetention*time.Second + time.Second))
+	if _, ok := rb.Ended()["elsewhere"]; ok {
+		t.Fatal("ended set kept after the retention")
+	}
+}
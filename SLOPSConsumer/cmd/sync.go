@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setEnd tells a peer that a message set of a key has ended.
+type setEnd struct {
+	Key string `json:"key"`
+	Set int32  `json:"set"`
+}
+
+// Endpoints is the reply of the controller for a service.
+type Endpoints struct {
+	Svcname string   `json:"Svcname"`
+	Ips     []string `json:"Ips"`
+}
+
+// Syncer shares the end of message sets with the other consumer instances.
+// Two partitions of a migrated key may be owned by different members of the
+// consumer group, so the member that sees set n-1 end has to tell the member
+// holding set n.
+type Syncer struct {
+	mu        sync.RWMutex
+	self      string   // Address of this instance, never sent to.
+	port      int      // Port every instance serves the sync API on.
+	peers     []string // Addresses of the other consumer instances.
+	discovery string   // Controller URL returning the consumer endpoints, if any.
+	buffer    *ReorderBuffer
+	client    *http.Client
+}
+
+// NewSyncer returns a syncer for the given buffer.
+// `peers` is a comma separated list of static peer addresses.
+func NewSyncer(buffer *ReorderBuffer, self string, port int, peers, discovery string) *Syncer {
+	s := &Syncer{
+		self:      self,
+		port:      port,
+		discovery: discovery,
+		buffer:    buffer,
+		client:    &http.Client{Timeout: 2 * time.Second},
+	}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" && peer != self {
+			s.peers = append(s.peers, peer)
+		}
+	}
+	buffer.onEnd = s.Broadcast
+	return s
+}
+
+// Run serves the sync API and keeps the peer list up to date.
+func (s *Syncer) Run() {
+	if s.discovery != "" {
+		s.refresh()
+		go func() {
+			// Check every 10 seconds if the endpoints have changed.
+			ticker := time.NewTicker(time.Second * 10)
+			for range ticker.C {
+				s.refresh()
+			}
+		}()
+	}
+	s.bootstrap()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sync", s.handle)
+	srv := http.Server{
+		Addr:         fmt.Sprintf(":%d", s.port),
+		Handler:      mux,
+		IdleTimeout:  time.Minute,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	log.Printf("Starting sync server on %s\n", srv.Addr)
+	log.Println(srv.ListenAndServe())
+}
+
+// Broadcast tells every peer that a message set has ended.
+func (s *Syncer) Broadcast(key string, set int32) {
+	body, err := json.Marshal(setEnd{Key: key, Set: set})
+	if err != nil {
+		log.Println("Sync encoding err:", err)
+		return
+	}
+	for _, peer := range s.Peers() {
+		go func(peer string) {
+			resp, err := s.client.Post(s.url(peer), "application/json", bytes.NewReader(body))
+			if err != nil {
+				log.Printf("Sync with %s failed: %v\n", peer, err)
+				return
+			}
+			resp.Body.Close()
+		}(peer)
+	}
+}
+
+// Peers returns the current peer addresses.
+func (s *Syncer) Peers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string(nil), s.peers...)
+}
+
+// handle receives set ends from peers and serves the known set ends to new instances.
+func (s *Syncer) handle(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var end setEnd
+		if err := json.NewDecoder(r.Body).Decode(&end); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.buffer.Advance(end.Key, end.Set)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.buffer.Ended())
+	default:
+		http.Error(w, fmt.Sprintf("the %s method is not supported for this resource", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// bootstrap copies the known set ends from the first peer that answers,
+// so that a restarted instance does not hold messages of sets that ended before it came up.
+func (s *Syncer) bootstrap() {
+	for _, peer := range s.Peers() {
+		resp, err := s.client.Get(s.url(peer))
+		if err != nil {
+			continue
+		}
+		var ended map[string]int32
+		err = json.NewDecoder(resp.Body).Decode(&ended)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		for key, set := range ended {
+			s.buffer.Advance(key, set)
+		}
+		log.Printf("Synced %d message sets from %s\n", len(ended), peer)
+		return
+	}
+}
+
+// refresh fetches the consumer endpoints from the controller.
+func (s *Syncer) refresh() {
+	resp, err := s.client.Get(s.discovery)
+	if err != nil {
+		log.Println("Error get request:", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var ep Endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		log.Println("Error json unmarshalling:", err)
+		return
+	}
+	peers := make([]string, 0, len(ep.Ips))
+	for _, ip := range ep.Ips {
+		if ip != s.self {
+			peers = append(peers, ip)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = peers
+}
+
+func (s *Syncer) url(peer string) string {
+	if !strings.Contains(peer, ":") {
+		peer = fmt.Sprintf("%s:%d", peer, s.port)
+	}
+	return fmt.Sprintf("http://%s/sync", peer)
+}
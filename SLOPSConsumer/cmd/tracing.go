@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// Span exporters, selected with TRACER_EXPORTER.
+const (
+	tracerOTLPGRPC = "otlp-grpc"
+	tracerOTLPHTTP = "otlp-http"
+	tracerJaeger   = "jaeger"
+	tracerStdout   = "stdout"
+	tracerNone     = "none"
+)
+
+// TracerProvider creates the tracer provider of the process.
+// TRACER_EXPORTER selects the exporter, jaeger by default, and TRACER_COLLECTOR its endpoint.
+// TRACER_INSECURE=true sends OTLP spans without TLS.
+// TRACE_SAMPLE_RATIO, 1 by default, only applies to messages without a trace;
+// the others follow the sampling decision of the producer.
+func TracerProvider() (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}))
+
+	name := os.Getenv("TRACER_EXPORTER")
+	if name == "" {
+		name = tracerJaeger
+	}
+	ratio := 1.0
+	if v := os.Getenv("TRACE_SAMPLE_RATIO"); v != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(v, 64); err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid TRACE_SAMPLE_RATIO %q", v)
+		}
+	}
+	exp, err := newSpanExporter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))
+	if exp == nil {
+		// Nothing is exported, so spans are not even recorded.
+		sampler = sdktrace.NeverSample()
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(os.Getenv("TRACER_NAME")),
+			attribute.String("exporter", name),
+		)),
+	}
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return tp, nil
+}
+
+// newSpanExporter returns the named exporter, nil for `none`.
+func newSpanExporter(name string) (sdktrace.SpanExporter, error) {
+	endpoint := os.Getenv("TRACER_COLLECTOR")
+	insecure, _ := strconv.ParseBool(os.Getenv("TRACER_INSECURE"))
+
+	switch name {
+	case tracerNone:
+		return nil, nil
+	case tracerJaeger:
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(endpoint)))
+	case tracerOTLPGRPC:
+		opts := make([]otlptracegrpc.Option, 0)
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(context.Background(), opts...)
+	case tracerOTLPHTTP:
+		opts := make([]otlptracehttp.Option, 0)
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	case tracerStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown TRACER_EXPORTER %q", name)
+	}
+}
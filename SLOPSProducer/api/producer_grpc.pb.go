@@ -0,0 +1,183 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: producer.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Producer_Publish_FullMethodName       = "/slops.producer.Producer/Publish"
+	Producer_PublishStream_FullMethodName = "/slops.producer.Producer/PublishStream"
+)
+
+// ProducerClient is the client API for Producer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ProducerClient interface {
+	// Publish sends one message.
+	Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error)
+	// PublishStream sends a stream of messages. Every request gets one response, in request order.
+	PublishStream(ctx context.Context, opts ...grpc.CallOption) (Producer_PublishStreamClient, error)
+}
+
+type producerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProducerClient(cc grpc.ClientConnInterface) ProducerClient {
+	return &producerClient{cc}
+}
+
+func (c *producerClient) Publish(ctx context.Context, in *PublishRequest, opts ...grpc.CallOption) (*PublishResponse, error) {
+	out := new(PublishResponse)
+	err := c.cc.Invoke(ctx, Producer_Publish_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *producerClient) PublishStream(ctx context.Context, opts ...grpc.CallOption) (Producer_PublishStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Producer_ServiceDesc.Streams[0], Producer_PublishStream_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &producerPublishStreamClient{stream}
+	return x, nil
+}
+
+type Producer_PublishStreamClient interface {
+	Send(*PublishRequest) error
+	Recv() (*PublishResponse, error)
+	grpc.ClientStream
+}
+
+type producerPublishStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *producerPublishStreamClient) Send(m *PublishRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *producerPublishStreamClient) Recv() (*PublishResponse, error) {
+	m := new(PublishResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ProducerServer is the server API for Producer service.
+// All implementations must embed UnimplementedProducerServer
+// for forward compatibility
+type ProducerServer interface {
+	// Publish sends one message.
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	// PublishStream sends a stream of messages. Every request gets one response, in request order.
+	PublishStream(Producer_PublishStreamServer) error
+	mustEmbedUnimplementedProducerServer()
+}
+
+// UnimplementedProducerServer must be embedded to have forward compatible implementations.
+type UnimplementedProducerServer struct {
+}
+
+func (UnimplementedProducerServer) Publish(context.Context, *PublishRequest) (*PublishResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Publish not implemented")
+}
+func (UnimplementedProducerServer) PublishStream(Producer_PublishStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method PublishStream not implemented")
+}
+func (UnimplementedProducerServer) mustEmbedUnimplementedProducerServer() {}
+
+// UnsafeProducerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ProducerServer will
+// result in compilation errors.
+type UnsafeProducerServer interface {
+	mustEmbedUnimplementedProducerServer()
+}
+
+func RegisterProducerServer(s grpc.ServiceRegistrar, srv ProducerServer) {
+	s.RegisterService(&Producer_ServiceDesc, srv)
+}
+
+func _Producer_Publish_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PublishRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProducerServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Producer_Publish_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProducerServer).Publish(ctx, req.(*PublishRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Producer_PublishStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ProducerServer).PublishStream(&producerPublishStreamServer{stream})
+}
+
+type Producer_PublishStreamServer interface {
+	Send(*PublishResponse) error
+	Recv() (*PublishRequest, error)
+	grpc.ServerStream
+}
+
+type producerPublishStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *producerPublishStreamServer) Send(m *PublishResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *producerPublishStreamServer) Recv() (*PublishRequest, error) {
+	m := new(PublishRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Producer_ServiceDesc is the grpc.ServiceDesc for Producer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Producer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "slops.producer.Producer",
+	HandlerType: (*ProducerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    _Producer_Publish_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "PublishStream",
+			Handler:       _Producer_PublishStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "producer.proto",
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShowPartitions returns the flows mapped to every partition.
+func (app *Application) ShowPartitions(c *gin.Context) {
+	env := envelope{
+		"partitions":     app.partitionMap.Snapshot(),
+		"sizes":          app.partitionMap.PartitionSizes(),
+		"system_average": app.partitionMap.SystemAvgSize(),
+		"health":         app.partitionMap.Health(),
+	}
+	if err := app.writeJSON(c.Writer, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// ShowPartition returns the flows mapped to one partition and its size.
+func (app *Application) ShowPartition(c *gin.Context) {
+	partition, err := strconv.Atoi(c.Param("partition"))
+	if err != nil || partition < 0 {
+		app.badRequestResponse(c, errors.New("invalid partition"))
+		return
+	}
+	kcArr, ok := app.partitionMap.Snapshot()[partition]
+	if !ok {
+		app.notFoundResponse(c)
+		return
+	}
+	env := envelope{
+		"partition": partition,
+		"keys":      kcArr,
+		"size":      app.partitionMap.PartitionSize(partition),
+		"healthy":   app.partitionMap.Healthy(partition),
+	}
+	if err := app.writeJSON(c.Writer, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// ShowSizes returns the system average and the size of every partition.
+func (app *Application) ShowSizes(c *gin.Context) {
+	env := envelope{
+		"sizes":          app.partitionMap.PartitionSizes(),
+		"system_average": app.partitionMap.SystemAvgSize(),
+	}
+	if err := app.writeJSON(c.Writer, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// ShowHotKeys returns the keys tracked by the heavy hitter detector.
+func (app *Application) ShowHotKeys(c *gin.Context) {
+	env := envelope{
+		"backend": app.conf.HeavyHitter,
+		"records": app.counter.TopK(0),
+	}
+	if err := app.writeJSON(c.Writer, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// ShowKey returns the current message set of a key and, for mapped keys, its partition map record.
+func (app *Application) ShowKey(c *gin.Context) {
+	key := c.Param("key")
+	env := envelope{}
+	if msgset, err := app.messageSets.GetKey(key); err == nil {
+		env["msgset"] = msgset
+	}
+	if kc, ok := app.partitionMap.Lookup(key); ok {
+		env["record"] = kc
+	}
+	if len(env) == 0 {
+		app.notFoundResponse(c)
+		return
+	}
+	if err := app.writeJSON(c.Writer, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// partitionInput is the body of the pin and migrate requests.
+type partitionInput struct {
+	Partition *int `json:"partition"`
+}
+
+// readPartition reads and validates the target partition of a request.
+func (app *Application) readPartition(c *gin.Context) (int, error) {
+	var input partitionInput
+	if err := app.readJSON(c, &input); err != nil {
+		return 0, err
+	}
+	if input.Partition == nil {
+		return 0, errors.New("partition must be provided")
+	}
+	if *input.Partition < 0 || *input.Partition >= int(app.conf.Partitions) {
+		return 0, fmt.Errorf("partition must be between 0 and %d", app.conf.Partitions-1)
+	}
+	return *input.Partition, nil
+}
+
+// onKeyQueue runs fn on the dispatch queue of a key and waits for it.
+// Changes to the partition of a key made this way take effect between two of its messages,
+// so the next message goes through `MsgsetHdrVal` and the consumers see the message set switch.
+func (app *Application) onKeyQueue(key string, fn func()) {
+	done := make(chan struct{})
+	app.dispatcher.Dispatch(key, func() {
+		fn()
+		close(done)
+	})
+	<-done
+}
+
+// PinKey maps a key to a partition and keeps it there.
+// Pinned keys are neither moved by the rebalancer nor demoted.
+func (app *Application) PinKey(c *gin.Context) {
+	if app.vanilla {
+		app.badRequestResponse(c, errors.New("keys can only be pinned with SMALOPS"))
+		return
+	}
+	key := c.Param("key")
+	partition, err := app.readPartition(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+
+	var src int
+	var kc internal.KeyRecord
+	app.onKeyQueue(key, func() {
+		src, kc = app.partitionMap.Pin(key, partition)
+	})
+	app.logger.Info().Str("key", key).Int("from", src).Int("partition", partition).Msg("key pinned")
+
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"record": kc}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// UnpinKey hands a pinned key back to the rebalancer and the heavy hitter detector.
+func (app *Application) UnpinKey(c *gin.Context) {
+	key := c.Param("key")
+	kc, ok := app.partitionMap.Unpin(key)
+	if !ok {
+		app.notFoundResponse(c)
+		return
+	}
+	app.logger.Info().Str("key", key).Int("partition", kc.Partition).Msg("key unpinned")
+
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"record": kc}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// MigrateKey moves a mapped key to a partition, ignoring the migration policy.
+func (app *Application) MigrateKey(c *gin.Context) {
+	if app.vanilla {
+		app.badRequestResponse(c, errors.New("keys can only be migrated with SMALOPS"))
+		return
+	}
+	key := c.Param("key")
+	partition, err := app.readPartition(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+
+	var move internal.Move
+	var ok bool
+	app.onKeyQueue(key, func() {
+		move, ok = app.partitionMap.ForceMove(key, partition)
+	})
+	if !ok {
+		app.notFoundResponse(c)
+		return
+	}
+	app.logger.Info().Str("key", key).Int("from", move.Src).Int("partition", move.Dst).Msg("key migrated")
+
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"move": move}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
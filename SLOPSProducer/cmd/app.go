@@ -1,29 +1,185 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/MSrvComm/SLOPSProducer/internal"
 	"github.com/rs/zerolog"
 )
 
 type Application struct {
-	vanilla      bool                    // If true then do not use the SLOPS algorithm.
-	ch           chan string             // Receive incoming keys through this channel.
-	conf         *internal.Config        // Hold the configuration data.
-	partitionMap *internal.PartitionMap  // Hot keys mapped to each partition.
-	messageSets  *internal.MessageSetMap // Map Message Sets
-	logger       zerolog.Logger          // System level logger.
-	producer     Producer                // Kafka producer.
+	vanilla        bool                     // If true then do not use the SLOPS algorithm.
+	ch             chan string              // Receive incoming keys through this channel.
+	conf           *internal.Config         // Hold the configuration data.
+	partitionMap   *internal.PartitionMap   // Hot keys mapped to each partition.
+	messageSets    *internal.MessageSetMap  // Map Message Sets
+	counter        internal.HeavyHitter     // Detects hot keys.
+	rebalancer     internal.Rebalancer      // Decides which flows to move.
+	plans          *internal.PlanQueue      // Rebalance plans waiting for approval.
+	logger         zerolog.Logger           // System level logger.
+	producer       Producer                 // Kafka producer.
+	dispatcher     *internal.Dispatcher     // Ordered per-key message pipeline.
+	metrics        *Metrics                 // Prometheus metrics.
+	state          *internal.StateStore     // Persists the partition map and the message sets, nil if disabled.
+	ingest         *internal.IngestLog      // Accepted messages not yet acknowledged by Kafka, nil if disabled.
+	retries        *taskQueue               // Messages Kafka failed to write, waiting to be routed again.
+	retryHolds     *retryHolds              // Messages held behind the retries of their key.
+	deadLetters    *taskQueue               // Messages that failed every retry, waiting for the dead letter topic.
+	deadLetterFile *internal.DeadLetterFile // Dead letters the topic could not take, nil if disabled.
+	replayMu       sync.Mutex               // One dead letter replay at a time.
+	drains         *drainer                 // Keys holding their new message set back, nil with the reorder strategy.
 }
 
-func NewApp(vanilla bool, conf *internal.Config) *Application {
+func NewApp(vanilla bool, conf *internal.Config) (*Application, error) {
+	counter, err := internal.NewHeavyHitter(conf)
+	if err != nil {
+		return nil, err
+	}
+	rebalancer, err := internal.NewRebalancer(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.RebalanceMode != internal.RebalanceAuto && conf.RebalanceMode != internal.RebalanceManual {
+		return nil, fmt.Errorf("unknown rebalance mode %q", conf.RebalanceMode)
+	}
+	switch conf.Transport {
+	case internal.TransportKafka:
+		// The brokers and client ID come from the environment unless they are configured.
+		if len(conf.Kafka.Brokers) == 0 && os.Getenv("KAFKA_BOOTSTRAP") != "" {
+			conf.Kafka.Brokers = splitBrokers(os.Getenv("KAFKA_BOOTSTRAP"))
+		}
+		if len(conf.Kafka.Brokers) == 0 {
+			return nil, errors.New("no Kafka brokers configured")
+		}
+		if conf.Kafka.ClientID == "" {
+			conf.Kafka.ClientID = os.Getenv("ADDRESS")
+		}
+		if _, err := conf.Kafka.Sarama(); err != nil {
+			return nil, err
+		}
+	case internal.TransportMemory:
+	default:
+		return nil, fmt.Errorf("unknown transport %q", conf.Transport)
+	}
+	if conf.DeadLetterTopic != "" && conf.DeadLetterTopic == conf.Kafka.Topic {
+		return nil, errors.New("dead_letter_topic must differ from the topic of the messages")
+	}
+	var drains *drainer
+	switch conf.MigrationStrategy {
+	case internal.MigrationReorder:
+	case internal.MigrationDrain:
+		if !vanilla {
+			drains = newDrainer()
+		}
+	default:
+		return nil, fmt.Errorf("unknown migration strategy %q", conf.MigrationStrategy)
+	}
+	var deadLetterFile *internal.DeadLetterFile
+	if conf.DeadLetterFile != "" {
+		deadLetterFile = internal.NewDeadLetterFile(conf.DeadLetterFile)
+	}
+	partitionMap := internal.NewPartitionMap()
 	return &Application{
 		vanilla:      vanilla,
 		ch:           make(chan string),
 		conf:         conf,
-		partitionMap: internal.NewPartitionMap(),
-		messageSets:  &internal.MessageSetMap{KV: map[string]internal.MessageSet{}},
-		logger:       zerolog.New(os.Stdout).With().Timestamp().Logger(),
+		partitionMap: partitionMap,
+		messageSets: &internal.MessageSetMap{
+			KV:     map[string]internal.MessageSet{},
+			Home:   homePartition(conf.Partitions),
+			Mapped: func(key string) bool { return partitionMap.GetKey(key) != nil },
+		},
+		counter:        counter,
+		rebalancer:     rebalancer,
+		plans:          internal.NewPlanQueue(conf.PendingPlans),
+		logger:         zerolog.New(os.Stdout).With().Timestamp().Logger(),
+		dispatcher:     internal.NewDispatcher(conf.DispatchWorkers, conf.DispatchQueue),
+		metrics:        NewMetrics(),
+		retries:        newTaskQueue(),
+		retryHolds:     newRetryHolds(),
+		deadLetters:    newTaskQueue(),
+		deadLetterFile: deadLetterFile,
+		drains:         drains,
+	}, nil
+}
+
+// splitBrokers splits a comma separated list of brokers, dropping spaces and empty entries.
+func splitBrokers(list string) []string {
+	brokers := make([]string, 0)
+	for _, broker := range strings.Split(list, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+// start restores the state saved before a restart, starts the producer with the loops that read
+// Kafka's acknowledgements and failures, then the dispatch queues, and replays the ingest log.
+// The replay can be larger than the dispatch queues and sarama's buffers together, so it only
+// goes through once the acknowledgements are read.
+func (app *Application) start(wg *sync.WaitGroup) error {
+	// Populate partitions in partition map.
+	app.partitionMap.PopulateMaps(int(app.conf.Partitions))
+	app.partitionMap.SetMigrationPolicy(app.conf.MigrationPolicy())
+	app.partitionMap.SetHealthPolicy(app.conf.HealthPolicy())
+
+	// Restore the state saved before a restart, before any message is routed.
+	if err := app.RestoreState(); err != nil {
+		return err
+	}
+	if app.state != nil {
+		wg.Add(1)
+		go app.SnapshotLoop(wg)
+	}
+
+	// Start the Kafka producer.
+	app.producer = app.NewProducer()
+
+	// Successes channel needs to be consumed for producer to run smoothly.
+	wg.Add(1)
+	go func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		for s := range app.producer.kafkaProducer.Successes() {
+			// Print out timestamp, partition and offset.
+			// Later we will use this to realize total rate of messages into a partition.
+			app.logger.Info().Msgf("Received Offset: %d at time %v on partition %d", s.Offset, s.Timestamp, s.Partition)
+			app.delivered(s)
+		}
+	}(wg)
+
+	// Errors channel needs to be consumed for producer to run smoothly.
+	wg.Add(1)
+	go func(wg *sync.WaitGroup) {
+		defer wg.Done()
+		for err := range app.producer.kafkaProducer.Errors() {
+			app.logger.Error().AnErr("Kafka Error", err)
+			app.deliveryFailed(err)
+		}
+	}(wg)
+
+	// Route the messages Kafka failed to write again.
+	wg.Add(1)
+	go app.retries.Run(wg)
+
+	// Write the messages that failed every retry to the dead letter topic.
+	wg.Add(1)
+	go app.deadLetters.Run(wg)
+
+	// Start the ordered dispatch queues.
+	app.dispatcher.Start()
+
+	// Send the messages accepted before a crash that Kafka never acknowledged.
+	if app.conf.IngestLogDir != "" {
+		if err := app.OpenIngestLog(); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go app.CheckpointIngestLog(wg)
 	}
+	return nil
 }
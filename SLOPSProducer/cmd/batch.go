@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Status of a record of a batch.
+const (
+	batchAccepted = "accepted" // Queued for Kafka.
+	batchProduced = "produced" // Acknowledged by Kafka, in synchronous mode.
+	batchFailed   = "failed"
+)
+
+// batchResult is the outcome of one record of a batch.
+type batchResult struct {
+	Index  int            `json:"index"`
+	Key    string         `json:"key"`
+	Status string         `json:"status"`
+	Error  string         `json:"error,omitempty"`
+	Result *produceResult `json:"result,omitempty"`
+}
+
+// NewBatch accepts a JSON array or newline-delimited JSON of messages.
+// Records are dispatched in the order of the batch, so the messages of a key keep their order.
+func (app *Application) NewBatch(c *gin.Context) {
+	sync, err := app.syncMode(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	inputs, err := app.readBatch(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+
+	results := make([]batchResult, len(inputs))
+	for i := range inputs {
+		results[i] = batchResult{Index: i, Key: inputs[i].Key, Status: batchAccepted}
+		if err := inputs[i].validate(); err != nil {
+			results[i].Status = batchFailed
+			results[i].Error = err.Error()
+			continue
+		}
+		if err := app.accept(&inputs[i], sync); err != nil {
+			app.logError(err)
+			results[i].Status = batchFailed
+			results[i].Error = "the message could not be logged"
+		}
+	}
+
+	if sync {
+		ctx, cancel := app.syncContext(c)
+		defer cancel()
+		for i := range inputs {
+			if results[i].Status == batchFailed {
+				continue
+			}
+			res, err := waitDelivery(ctx, inputs[i].result)
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				results[i].Status = batchFailed
+				results[i].Error = "timed out waiting for Kafka"
+			case err != nil: // The client went away.
+				return
+			case res.err != nil:
+				results[i].Status = batchFailed
+				results[i].Error = res.err.Error()
+			default:
+				results[i].Status = batchProduced
+				results[i].Result = &res
+			}
+		}
+	}
+
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"results": results}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// readBatch decodes the records of a batch. A body starting with `[` is a JSON array,
+// anything else is read as a stream of JSON records, one per line.
+func (app *Application) readBatch(c *gin.Context) ([]kInput, error) {
+	maxBytes := app.conf.BatchMaxBytes
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+
+	r := bufio.NewReader(c.Request.Body)
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+
+	inputs := make([]kInput, 0)
+	first, err := peekNonSpace(r)
+	if err == io.EOF {
+		return nil, errors.New("body must not be empty")
+	} else if err != nil {
+		return nil, batchError(err, 0, maxBytes)
+	}
+	if first == '[' {
+		if err := dec.Decode(&inputs); err != nil {
+			return nil, batchError(err, -1, maxBytes)
+		}
+		if dec.More() {
+			return nil, errors.New("body must only contain a single JSON array")
+		}
+	} else {
+		for {
+			var input kInput
+			err := dec.Decode(&input)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, batchError(err, len(inputs), maxBytes)
+			}
+			inputs = append(inputs, input)
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, errors.New("batch must not be empty")
+	}
+	return inputs, nil
+}
+
+// peekNonSpace returns the first byte of r that is not white space, without consuming it.
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// batchError describes a decoding error. `record` is the index of the failing record, -1 if unknown.
+func batchError(err error, record int, maxBytes int64) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var maxBytesError *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesError):
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed JSON")
+	case errors.As(err, &unmarshalTypeError) && record >= 0:
+		return fmt.Errorf("record %d contains incorrect JSON type for field %q", record, unmarshalTypeError.Field)
+	case errors.As(err, &unmarshalTypeError):
+		return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+	case strings.HasPrefix(err.Error(), "json: unknown field ") && record >= 0:
+		return fmt.Errorf("record %d contains unknown key %s", record, strings.TrimPrefix(err.Error(), "json: unknown field "))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return fmt.Errorf("body contains unknown key %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	case record >= 0:
+		return fmt.Errorf("record %d: %v", record, err)
+	default:
+		return err
+	}
+}
@@ -5,94 +5,130 @@ import (
 	"math/rand"
 	"sync"
 	"time"
-)
 
-// Record struct.
-type Record struct {
-	Key    string
-	Count  uint64
-	Bucket int
-}
+	"github.com/MSrvComm/SLOPSProducer/internal"
+)
 
-func (app *Application) LossyCount(wg *sync.WaitGroup) {
+// TrackKeys feeds sampled keys to the heavy hitter detector.
+// Every 1/epsilon keys the bucket turns over: the weights of the mapped flows
+// are decayed towards their count in the bucket, tracked keys above the support
+// threshold are mapped to a partition and keys that are not tracked anymore,
+// or whose count fell to the error bound, are removed from the partition map.
+// Both thresholds are relative to the observations the detector's counts cover.
+func (app *Application) TrackKeys(wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	// Hold hot keys.
-	items := make([]Record, 0)
 	currentBucket := 1
 	N := 0
 	width := int(math.Floor(1 / app.conf.Epsilon))
+	halfLife := time.Duration(app.conf.DecayHalfLife * float64(time.Second))
+	idle := time.Duration(app.conf.DemotionIdle * float64(time.Second))
+	observed := make(map[string]uint64) // Messages per key in the current bucket.
+	bucketStart := time.Now()
 
 	for {
 		key := <-app.ch
 		N++
-
-		// Key is known.
-		if index, b := checkKeyList(key, &items); b {
-			items[index].Count++
-		} else {
-			// Adding new key to records.
-			rec := Record{Key: key, Count: 1, Bucket: currentBucket - 1}
-			items = append(items, rec)
-		}
+		observed[key]++
+		app.counter.Observe(key)
 
 		// The bucket turns over.
 		if N >= width {
-			// Do not change the ds while iterating over it.
-			newItems := make([]Record, 0)
-
-			for _, rec := range items {
-				// Reduce count of each index.
-				rec.Count--
-				if rec.Count+uint64(rec.Bucket) >= uint64(currentBucket) {
-					// This item stays.
-					newItems = append(newItems, rec)
+			// The counts are read before the bucket ends: ending it can slide
+			// the oldest bucket out of the window, which is this one with a window of 1.
+			records := app.counter.TopK(0)
+			hot, cold := internal.Thresholds(app.counter, app.conf.Support, app.conf.Epsilon)
+			app.counter.EndBucket()
+			tracked := make(map[string]uint64, len(records))
+			for _, rec := range records {
+				tracked[rec.Key] = rec.Count
+			}
+			// Decay the weights of the flows already mapped.
+			now := time.Now()
+			app.partitionMap.Refresh(tracked, observed, internal.DecayAlpha(now.Sub(bucketStart), halfLife))
 
-					// If value is above a threshold.
-					if float64(rec.Count) >= (app.conf.Support-app.conf.Epsilon)*float64(N) {
-						// If a new hot key is detected, add it.
-						m := app.partitionMap.GetKey(rec.Key)
-						if m == nil {
-							// Map to a new partition.
-							p := app.MapToPartition()
-							app.partitionMap.AddKey(rec.Key, rec.Count, p)
-						}
+			for _, rec := range records {
+				// If value is above a threshold.
+				if float64(rec.Count) >= hot {
+					// If a new hot key is detected, add it.
+					m := app.partitionMap.GetKey(rec.Key)
+					if m == nil {
+						// Map to a new partition.
+						p := app.MapToPartition()
+						app.partitionMap.AddKey(rec.Key, rec.Count, float64(observed[rec.Key]), p)
+					} else {
+						// A demoted key that is hot again keeps its partition.
+						app.partitionMap.Promote(rec.Key)
 					}
-				} else {
-					app.partitionMap.DeleteKey(rec.Key)
+				}
+			}
+			// Keys the detector dropped are not hot anymore.
+			for _, key := range app.partitionMap.Keys() {
+				if count, ok := tracked[key]; !ok || float64(count) <= cold {
+					app.demoteKey(key)
+				}
+			}
+			// Release the demoted keys that went idle.
+			if idle > 0 {
+				for _, key := range app.partitionMap.IdleDemoted(idle) {
+					app.releaseKey(key)
 				}
 			}
 			// Increment current bucket.
 			currentBucket++
+			app.metrics.EndBucket(currentBucket, len(records), len(app.partitionMap.Keys()))
 			// Reset N.
 			N = 0
-			// Update items.
-			items = newItems
+			observed = make(map[string]uint64)
+			bucketStart = now
 
 			// Log print.
-			app.logger.Debug().Int("N:", N)
-			app.logger.Debug().Int("Current Bucket:", currentBucket)
-			app.logger.Debug().Int("#Keys tracking:", len(items))
+			app.logger.Debug().
+				Int("Current Bucket", currentBucket).
+				Int("#Keys tracking", len(records)).
+				Msg("heavy hitter bucket turned over")
 		}
 	}
 }
 
-// Check if key is already being tracked.
-func checkKeyList(key string, items *[]Record) (int, bool) {
-	for index, rec := range *items {
-		if rec.Key == key {
-			return index, true
-		}
+// demoteKey handles a key that is not hot anymore.
+// With `demotion_idle` set the key stays on its partition until it goes idle,
+// otherwise it is released right away.
+func (app *Application) demoteKey(key string) {
+	if app.conf.DemotionIdle > 0 {
+		app.partitionMap.Demote(key)
+		return
 	}
-	return -1, false
+	app.releaseKey(key)
+}
+
+// releaseKey removes a key from the partition map so its messages are hashed again.
+// Pinned keys are kept.
+// The removal is queued behind the messages of the key already dispatched,
+// so it takes effect between two messages. The next message then goes through
+// `MsgsetHdrVal` like any other partition change: it starts a new message set
+// and the old partition receives the end of the previous set.
+func (app *Application) releaseKey(key string) {
+	app.dispatcher.Dispatch(key, func() {
+		if kc := app.partitionMap.Release(key); kc != nil {
+			app.logger.Info().Str("key", key).Int("partition", kc.Partition).Msg("key demoted")
+		}
+	})
 }
 
 // Create Mapping to partition for a new hot key.
+// Unhealthy partitions are skipped, unless no partition is healthy.
 func (app *Application) MapToPartition() int {
+	partitions := app.partitionMap.HealthyPartitions(int(app.conf.Partitions))
+	if len(partitions) == 0 {
+		for p := 0; p < int(app.conf.Partitions); p++ {
+			partitions = append(partitions, p)
+		}
+	}
 
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	p1 := int(r.Int31n(app.conf.Partitions))
-	p2 := int(r.Int31n(app.conf.Partitions))
+	p1 := partitions[r.Intn(len(partitions))]
+	p2 := partitions[r.Intn(len(partitions))]
 
 	v1 := app.partitionMap.PartitionSize(p1)
 	v2 := app.partitionMap.PartitionSize(p2)
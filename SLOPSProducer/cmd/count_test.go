@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+)
+
+// TestTrackKeysExactWindow turns buckets over with an exact counter whose window is the
+// current bucket only: its hot key must be mapped, and stay mapped while it is hot.
+func TestTrackKeysExactWindow(t *testing.T) {
+	var conf internal.Config
+	yaml := "transport: memory\npartitions: 3\nheavy_hitter: exact\nexact_window: 1\nepsilon: 0.1\nsupport: 0.3\n"
+	if err := conf.Parse([]byte(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp(false, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.partitionMap.PopulateMaps(int(conf.Partitions))
+	app.dispatcher.Start()
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go app.TrackKeys(wg)
+
+	// A bucket is 1/epsilon keys, 8 of them the hot key.
+	bucket := []string{"hot", "hot", "hot", "hot", "cold-1", "hot", "hot", "hot", "hot", "cold-2"}
+	for round := 1; round <= 3; round++ {
+		for _, key := range bucket {
+			app.ch <- key
+		}
+		// The next key is only read once the bucket turned over,
+		// and the demotions it queued run before this task.
+		app.ch <- "next"
+		done := make(chan struct{})
+		app.dispatcher.Dispatch("hot", func() { close(done) })
+		<-done
+
+		if app.partitionMap.GetKey("hot") == nil {
+			t.Fatalf("round %d: the hot key is not mapped", round)
+		}
+		for _, key := range []string{"cold-1", "cold-2"} {
+			if app.partitionMap.GetKey(key) != nil {
+				t.Errorf("round %d: %s is mapped", round, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"github.com/Shopify/sarama"
+	"github.com/gin-gonic/gin"
+)
+
+// deadLetter travels with a dead letter through sarama in `ProducerMessage.Metadata`.
+type deadLetter struct {
+	letter internal.DeadLetter
+	seq    uint64 // Sequence number of the message in the ingest log, 0 if it is not logged.
+}
+
+// sendDeadLetter hands a message that failed every retry to the dead letter topic,
+// or to the dead letter file without one.
+func (app *Application) sendDeadLetter(d *delivery, perr *sarama.ProducerError) {
+	dl := &deadLetter{
+		letter: internal.DeadLetter{
+			Key:       d.input.Key,
+			Body:      d.input.Body,
+			Headers:   d.input.Headers,
+			Partition: perr.Msg.Partition,
+			Msgset:    d.msgset,
+			Error:     perr.Err.Error(),
+			Retries:   d.input.attempts,
+			FailedAt:  time.Now(),
+		},
+		seq: d.input.seq,
+	}
+	if app.conf.DeadLetterTopic == "" {
+		app.keepDeadLetter(dl)
+		return
+	}
+	value, err := json.Marshal(dl.letter)
+	if err != nil {
+		app.keepDeadLetter(dl)
+		return
+	}
+	// sarama's input must not be written from its result loops. The dead letters
+	// all go to partition 0, so the topic keeps the order they failed in.
+	app.deadLetters.push(task{
+		at: time.Now(),
+		run: func() {
+			app.producer.kafkaProducer.Input() <- &sarama.ProducerMessage{
+				Topic:     app.conf.DeadLetterTopic,
+				Key:       sarama.StringEncoder(dl.letter.Key),
+				Value:     sarama.ByteEncoder(value),
+				Partition: 0,
+				Metadata:  dl,
+			}
+		},
+	})
+}
+
+// keepDeadLetter writes a dead letter the topic could not take to the dead letter file.
+// Without one, or if the file cannot be written, the message is kept by the ingest log for the next start.
+// Without an ingest log either the message is lost: it is logged and counted as dropped.
+func (app *Application) keepDeadLetter(dl *deadLetter) {
+	if app.deadLetterFile != nil {
+		err := app.deadLetterFile.Append(dl.letter)
+		if err == nil {
+			app.deadLettered(dl, "file")
+			return
+		}
+		app.logger.Error().AnErr("dead letter file", err).Str("key", dl.letter.Key).Msg("dead letter could not be kept")
+	}
+	if app.ingestFail(kInput{Key: dl.letter.Key, Body: dl.letter.Body, Headers: dl.letter.Headers, seq: dl.seq}) {
+		return
+	}
+	app.logger.Error().
+		Str("key", dl.letter.Key).
+		Int32("partition", dl.letter.Partition).
+		Str("error", dl.letter.Error).
+		Msg("dead letter dropped")
+	app.metrics.DeadLettered("dropped")
+}
+
+// deadLettered handles a dead letter written to the topic or the file.
+func (app *Application) deadLettered(dl *deadLetter, destination string) {
+	app.logger.Warn().
+		Str("key", dl.letter.Key).
+		Int32("partition", dl.letter.Partition).
+		Str("error", dl.letter.Error).
+		Str("destination", destination).
+		Msg("message dead-lettered")
+	app.metrics.DeadLettered(destination)
+	app.ingestAck(dl.seq)
+}
+
+// ReplayDeadLetters sends the dead letters again through the ordered path, as new messages:
+// first the ones in the dead letter file, then the ones in the dead letter topic after the last replay.
+func (app *Application) ReplayDeadLetters(c *gin.Context) {
+	app.replayMu.Lock()
+	defer app.replayMu.Unlock()
+
+	fromFile, err := app.replayDeadLetterFile()
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	fromTopic, err := app.replayDeadLetterTopic(c.Request.Context())
+	if err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+	app.logger.Info().Int("file", fromFile).Int("topic", fromTopic).Msg("dead letters replayed")
+
+	env := envelope{"replayed": envelope{"file": fromFile, "topic": fromTopic}}
+	if err := app.writeJSON(c.Writer, http.StatusOK, env, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// replayDeadLetter accepts a dead letter like a message received over HTTP.
+func (app *Application) replayDeadLetter(dl internal.DeadLetter) error {
+	input := kInput{Key: dl.Key, Body: dl.Body, Headers: dl.Headers}
+	return app.accept(&input, false)
+}
+
+// replayDeadLetterFile replays and empties the dead letter file. Returns the number of messages replayed.
+func (app *Application) replayDeadLetterFile() (int, error) {
+	if app.deadLetterFile == nil {
+		return 0, nil
+	}
+	letters, err := app.deadLetterFile.Drain()
+	if err != nil {
+		return 0, err
+	}
+	for i, dl := range letters {
+		if err := app.replayDeadLetter(dl); err != nil {
+			// Keep the dead letters that were not replayed.
+			for _, rest := range letters[i:] {
+				if err := app.deadLetterFile.Append(rest); err != nil {
+					app.logger.Error().AnErr("dead letter file", err).Str("key", rest.Key).Msg("dead letter could not be kept")
+				}
+			}
+			return i, err
+		}
+	}
+	return len(letters), nil
+}
+
+// replayDeadLetterTopic replays the dead letter topic from the offset committed by the last replay
+// up to its current end. Returns the number of messages replayed.
+func (app *Application) replayDeadLetterTopic(ctx context.Context) (int, error) {
+	topic := app.conf.DeadLetterTopic
+	if topic == "" {
+		return 0, nil
+	}
+	broker := app.producer.broker
+	end, err := broker.NewestOffset(topic, 0)
+	if err != nil {
+		return 0, err
+	}
+	offset, err := broker.Committed(internal.DeadLetterReplayGroup, topic, 0)
+	if err != nil {
+		return 0, err
+	}
+	if end == 0 || offset >= end {
+		return 0, nil
+	}
+	pc, err := broker.ConsumePartition(topic, 0, offset)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	replayed := 0
+	next := offset // Offset after the last message replayed.
+	idle := time.Duration(app.conf.SyncTimeout) * time.Millisecond
+	for next < end {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return replayed, errors.New("dead letter topic closed")
+			}
+			var dl internal.DeadLetter
+			if err := json.Unmarshal(msg.Value, &dl); err != nil {
+				app.logger.Error().AnErr("dead letter", err).Int64("offset", msg.Offset).Msg("dead letter skipped")
+			} else if err := app.replayDeadLetter(dl); err != nil {
+				return replayed, app.commitReplay(next, err)
+			} else {
+				replayed++
+			}
+			next = msg.Offset + 1
+		case <-time.After(idle):
+			return replayed, app.commitReplay(next, errors.New("timed out reading the dead letter topic"))
+		case <-ctx.Done():
+			return replayed, app.commitReplay(next, ctx.Err())
+		}
+	}
+	return replayed, app.commitReplay(next, nil)
+}
+
+// commitReplay records how far the dead letter topic was replayed and returns the error that stopped the replay.
+func (app *Application) commitReplay(next int64, cause error) error {
+	if next < 0 {
+		return cause
+	}
+	if err := app.producer.broker.Commit(internal.DeadLetterReplayGroup, app.conf.DeadLetterTopic, 0, next); err != nil {
+		return err
+	}
+	return cause
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"github.com/Shopify/sarama"
+	"github.com/gin-gonic/gin"
+)
+
+// delivery travels with a message through sarama in `ProducerMessage.Metadata`,
+// so the acknowledgement can be matched with the request that sent the message.
+type delivery struct {
+	input       kInput               // The message as it was accepted.
+	msgsetIndex int32                // Message set of the message, -1 without SMALOPS.
+	migrated    bool                 // The message started a new message set on another partition.
+	msgset      *internal.MessageSet // Message set header of the message, nil without SMALOPS.
+}
+
+// produceResult is the outcome of a message sent in synchronous mode.
+type produceResult struct {
+	Partition   int32 `json:"partition"`
+	Offset      int64 `json:"offset"`
+	MsgsetIndex int32 `json:"msgset_index"`
+	Migrated    bool  `json:"migrated"`
+	err         error
+}
+
+// reply hands the result of a message to the request waiting for it, if any.
+func (in kInput) reply(res produceResult) {
+	if in.result != nil {
+		in.result <- res
+	}
+}
+
+// delivered handles a message acknowledged by Kafka.
+func (app *Application) delivered(msg *sarama.ProducerMessage) {
+	if dl, ok := msg.Metadata.(*deadLetter); ok {
+		app.deadLettered(dl, "topic")
+		return
+	}
+	if cr, ok := msg.Metadata.(*controlRecord); ok {
+		app.produceSucceeded(msg.Partition)
+		app.controlSettled(cr)
+		return
+	}
+	app.metrics.Produced(msg.Partition)
+	app.produceSucceeded(msg.Partition)
+	d, ok := msg.Metadata.(*delivery)
+	if !ok {
+		return
+	}
+	if app.drains != nil {
+		app.drains.settled(d.input.Key)
+	}
+	app.ingestAck(d.input.seq)
+	if d.input.attempts > 0 {
+		app.retrySettled(d.input.Key)
+	}
+	d.input.reply(produceResult{
+		Partition:   msg.Partition,
+		Offset:      msg.Offset,
+		MsgsetIndex: d.msgsetIndex,
+		Migrated:    d.migrated,
+	})
+}
+
+// deliveryFailed handles a message Kafka failed to write.
+// The message is routed again up to `produce_retries` times before it is given up on
+// and dead-lettered.
+func (app *Application) deliveryFailed(perr *sarama.ProducerError) {
+	if dl, ok := perr.Msg.Metadata.(*deadLetter); ok {
+		app.logger.Error().AnErr("Kafka Error", perr.Err).Str("key", dl.letter.Key).Msg("dead letter topic failed")
+		app.keepDeadLetter(dl)
+		return
+	}
+	if cr, ok := perr.Msg.Metadata.(*controlRecord); ok {
+		// Not retried: the new message set is already on its way. Consumers release it
+		// once their reorder timeout expires.
+		app.logger.Warn().AnErr("Kafka Error", perr.Err).Str("key", cr.key).Int32("partition", cr.partition).Msg("end of message set lost")
+		app.produceFailed(perr.Msg.Partition)
+		app.controlSettled(cr)
+		return
+	}
+	app.metrics.ProduceError(perr.Msg.Partition)
+	app.produceFailed(perr.Msg.Partition)
+	d, ok := perr.Msg.Metadata.(*delivery)
+	if !ok {
+		return
+	}
+	if app.drains != nil {
+		app.drains.settled(d.input.Key)
+	}
+	input := d.input
+	input.startsSet = input.startsSet || d.migrated
+	if app.retry(input) {
+		return
+	}
+	app.sendDeadLetter(d, perr)
+	d.input.reply(produceResult{Partition: perr.Msg.Partition, err: perr.Err})
+}
+
+// controlSettled handles a control record Kafka acknowledged or rejected.
+func (app *Application) controlSettled(cr *controlRecord) {
+	if app.drains != nil {
+		app.drains.settled(cr.key)
+	}
+}
+
+// awaitDelivery answers a synchronous request once Kafka acknowledged or rejected its message.
+func (app *Application) awaitDelivery(c *gin.Context, result <-chan produceResult) {
+	ctx, cancel := app.syncContext(c)
+	defer cancel()
+
+	res, err := waitDelivery(ctx, result)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		app.errorResponse(c, http.StatusGatewayTimeout, "timed out waiting for Kafka")
+	case err != nil: // The client went away.
+	case res.err != nil:
+		app.errorResponse(c, http.StatusBadGateway, res.err.Error())
+	default:
+		if err := app.writeJSON(c.Writer, http.StatusCreated, envelope{"result": res}, nil); err != nil {
+			app.serverErrorResponse(c, err)
+		}
+	}
+}
+
+// syncContext bounds the wait of a synchronous request by `sync_timeout`.
+func (app *Application) syncContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(c.Request.Context(), time.Duration(app.conf.SyncTimeout)*time.Millisecond)
+}
+
+// waitDelivery waits for the outcome of a message until the context is done.
+func waitDelivery(ctx context.Context, result <-chan produceResult) (produceResult, error) {
+	select {
+	case res := <-result:
+		return res, nil
+	case <-ctx.Done():
+		return produceResult{}, ctx.Err()
+	}
+}
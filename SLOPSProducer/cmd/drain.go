@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// drainPoll is how often a drain checks the offsets committed by `drain_group`.
+const drainPoll = 100 * time.Millisecond
+
+// drainer implements the drain migration strategy: a key switching partition holds its
+// new message set back until the old one drained, that is until every message already
+// sent for the key was acknowledged by Kafka and, with `drain_group` set, the consumer
+// group committed the old partition past them.
+type drainer struct {
+	mu       sync.Mutex
+	inflight map[string]int    // Messages of each key handed to sarama and not acknowledged or failed yet.
+	drains   map[string]*drain // Keys holding their new message set back.
+}
+
+// drain is a key waiting for its old message set to drain.
+type drain struct {
+	src     int32         // Partition of the old message set.
+	started time.Time     // When the first message was held.
+	held    []kInput      // Messages of the new set, in order.
+	settled chan struct{} // Closed once no message of the key is in flight.
+	closed  bool
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		inflight: map[string]int{},
+		drains:   map[string]*drain{},
+	}
+}
+
+// sent records a message handed to sarama.
+func (dr *drainer) sent(key string) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	dr.inflight[key]++
+}
+
+// settled records a message acknowledged by Kafka or given up on.
+func (dr *drainer) settled(key string) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	dr.inflight[key]--
+	if dr.inflight[key] > 0 {
+		return
+	}
+	delete(dr.inflight, key)
+	if d, ok := dr.drains[key]; ok {
+		d.settle()
+	}
+}
+
+// settle wakes up the drain once the old set is acknowledged. Callers hold the lock.
+func (d *drain) settle() {
+	if !d.closed {
+		close(d.settled)
+		d.closed = true
+	}
+}
+
+// hold adds a message to the drain of its key. Returns false if the key is not draining.
+func (dr *drainer) hold(input kInput) bool {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	d, ok := dr.drains[input.Key]
+	if ok {
+		d.held = append(d.held, input)
+	}
+	return ok
+}
+
+// idle reports whether no message of a key is in flight.
+func (dr *drainer) idle(key string) bool {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	return dr.inflight[key] == 0
+}
+
+// start holds a message of a key leaving partition src until the old set drained.
+func (dr *drainer) start(input kInput, src int32) *drain {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	d := &drain{
+		src:     src,
+		started: time.Now(),
+		held:    []kInput{input},
+		settled: make(chan struct{}),
+	}
+	if dr.inflight[input.Key] == 0 {
+		d.settle()
+	}
+	dr.drains[input.Key] = d
+	return d
+}
+
+// finish ends the drain of a key and returns it, nil if the key was not draining.
+func (dr *drainer) finish(key string) *drain {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+
+	d := dr.drains[key]
+	delete(dr.drains, key)
+	return d
+}
+
+// holdForDrain holds a message back while the old message set of its key drains.
+// It runs on the key's dispatch queue, before the message is produced to `partition`.
+// Returns true if the message was held.
+func (app *Application) holdForDrain(input *kInput, partition int32) bool {
+	if app.drains == nil || input.released {
+		return false
+	}
+	// Messages behind a held one are held too, so the key keeps its order.
+	if app.drains.hold(*input) {
+		return true
+	}
+	last, err := app.messageSets.GetKey(input.Key)
+	if err != nil || last.DestPartition == partition {
+		return false
+	}
+	// Nothing left to wait for.
+	if app.conf.DrainGroup == "" && app.drains.idle(input.Key) {
+		input.drained = true
+		return false
+	}
+	d := app.drains.start(*input, last.DestPartition)
+	app.partitionMap.SetMigrating(input.Key, true)
+	app.logger.Info().Str("key", input.Key).Int32("from", last.DestPartition).Int32("partition", partition).Msg("key draining")
+	go app.awaitDrain(input.Key, d)
+	return true
+}
+
+// awaitDrain waits for the old message set of a key to drain, for at most `drain_timeout`,
+// then releases the held messages on the key's dispatch queue.
+func (app *Application) awaitDrain(key string, d *drain) {
+	deadline := d.started.Add(time.Duration(app.conf.DrainTimeout) * time.Millisecond)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	drained := true
+	select {
+	case <-d.settled:
+	case <-timer.C:
+		drained = false
+	}
+	if drained && app.conf.DrainGroup != "" {
+		drained = app.awaitCommitted(d.src, deadline)
+	}
+	app.dispatcher.Dispatch(key, func() {
+		app.releaseDrain(key, drained)
+	})
+}
+
+// awaitCommitted waits until `drain_group` committed a partition up to its current end.
+// Returns false if the deadline passed first.
+func (app *Application) awaitCommitted(partition int32, deadline time.Time) bool {
+	topic := app.producer.sysDetails.kafkaTopic
+	end, err := app.producer.broker.NewestOffset(topic, partition)
+	if err != nil {
+		app.logger.Error().AnErr("drain", err).Int32("partition", partition).Msg("cannot read the end of the partition")
+		return false
+	}
+	for {
+		committed, err := app.producer.broker.Committed(app.conf.DrainGroup, topic, partition)
+		if err != nil {
+			app.logger.Error().AnErr("drain", err).Int32("partition", partition).Msg("cannot read the committed offset")
+		} else if committed >= end {
+			return true
+		}
+		if time.Now().Add(drainPoll).After(deadline) {
+			return false
+		}
+		time.Sleep(drainPoll)
+	}
+}
+
+// releaseDrain routes the messages a drain held, on the key's dispatch queue.
+// The first one starts the new message set. Once the old set drained it goes to the
+// new partition and tells the consumers the old set ended; after a timeout a control
+// record ends the old set on the old partition like the reorder strategy.
+func (app *Application) releaseDrain(key string, drained bool) {
+	app.partitionMap.SetMigrating(key, false)
+	d := app.drains.finish(key)
+	if d == nil {
+		return
+	}
+	app.metrics.Drained(drained, time.Since(d.started))
+	if !drained {
+		app.logger.Warn().Str("key", key).Int("messages", len(d.held)).Msg("drain timed out")
+	}
+	d.held[0].released = true
+	d.held[0].drained = drained
+	for _, input := range d.held {
+		app.route(input)
+	}
+}
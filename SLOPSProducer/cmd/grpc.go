@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer is the gRPC ingest service. Messages take the same path as `POST /new`.
+type grpcServer struct {
+	api.UnimplementedProducerServer
+	app *Application
+}
+
+// ServeGRPC runs the gRPC ingest service on `grpc_port`.
+func (app *Application) ServeGRPC() error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", app.conf.GRPCPort))
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer()
+	api.RegisterProducerServer(srv, &grpcServer{app: app})
+	app.logger.Info().Msg(fmt.Sprintf("Starting gRPC server on %s", lis.Addr()))
+	return srv.Serve(lis)
+}
+
+// pendingPublish is a streamed message waiting for its response.
+type pendingPublish struct {
+	req      *api.PublishRequest
+	input    kInput
+	err      error     // The message was not accepted.
+	deadline time.Time // Synchronous messages wait for Kafka until then.
+}
+
+// accept takes in the message of a request.
+func (s *grpcServer) accept(req *api.PublishRequest) (kInput, error) {
+	input := kInput{Key: req.Key, Body: req.Body, Headers: req.Headers}
+	if err := input.validate(); err != nil {
+		return input, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.app.accept(&input, s.syncMode(req)); err != nil {
+		s.app.logError(err)
+		return input, status.Error(codes.Internal, "the message could not be logged")
+	}
+	return input, nil
+}
+
+// syncMode reports whether a request waits for Kafka: its `sync` field if set, `sync_produce` otherwise.
+func (s *grpcServer) syncMode(req *api.PublishRequest) bool {
+	if req.Sync != nil {
+		return *req.Sync
+	}
+	return s.app.conf.SyncProduce
+}
+
+// Publish implements api.ProducerServer.
+func (s *grpcServer) Publish(ctx context.Context, req *api.PublishRequest) (*api.PublishResponse, error) {
+	input, err := s.accept(req)
+	if err != nil {
+		return nil, err
+	}
+	resp := &api.PublishResponse{Id: req.Id, Key: req.Key, Status: api.PublishResponse_ACCEPTED}
+	if input.result == nil {
+		return resp, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.app.conf.SyncTimeout)*time.Millisecond)
+	defer cancel()
+	res, err := waitDelivery(ctx, input.result)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, status.Error(codes.DeadlineExceeded, "timed out waiting for Kafka")
+	case err != nil:
+		return nil, status.FromContextError(err).Err()
+	case res.err != nil:
+		return nil, status.Error(codes.Unavailable, res.err.Error())
+	}
+	produced(resp, res)
+	return resp, nil
+}
+
+// PublishStream implements api.ProducerServer.
+// Messages are accepted as they arrive and answered in the same order,
+// synchronous ones once Kafka acknowledged them.
+func (s *grpcServer) PublishStream(stream api.Producer_PublishStreamServer) error {
+	pending := make(chan pendingPublish, s.app.conf.DispatchQueue)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.respond(stream, pending)
+	}()
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			close(pending)
+			<-done
+			return err
+		}
+		p := pendingPublish{req: req}
+		p.input, p.err = s.accept(req)
+		p.deadline = time.Now().Add(time.Duration(s.app.conf.SyncTimeout) * time.Millisecond)
+		select {
+		case pending <- p:
+		case err := <-done: // The responses failed.
+			close(pending)
+			return err
+		}
+	}
+	close(pending)
+	return <-done
+}
+
+// respond sends the responses of a stream in request order.
+func (s *grpcServer) respond(stream api.Producer_PublishStreamServer, pending <-chan pendingPublish) error {
+	for p := range pending {
+		resp := &api.PublishResponse{Id: p.req.Id, Key: p.req.Key, Status: api.PublishResponse_ACCEPTED}
+		switch {
+		case p.err != nil:
+			resp.Status = api.PublishResponse_FAILED
+			resp.Error = status.Convert(p.err).Message()
+		case p.input.result != nil:
+			ctx, cancel := context.WithDeadline(stream.Context(), p.deadline)
+			res, err := waitDelivery(ctx, p.input.result)
+			cancel()
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				resp.Status = api.PublishResponse_FAILED
+				resp.Error = "timed out waiting for Kafka"
+			case err != nil: // The client went away.
+				return err
+			case res.err != nil:
+				resp.Status = api.PublishResponse_FAILED
+				resp.Error = res.err.Error()
+			default:
+				produced(resp, res)
+			}
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// produced fills in a response with the outcome of a message acknowledged by Kafka.
+func produced(resp *api.PublishResponse, res produceResult) {
+	resp.Status = api.PublishResponse_PRODUCED
+	resp.Partition = res.Partition
+	resp.Offset = res.Offset
+	resp.MsgsetIndex = res.MsgsetIndex
+	resp.Migrated = res.Migrated
+}
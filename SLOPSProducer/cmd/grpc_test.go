@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/MSrvComm/SLOPSProducer/api"
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"google.golang.org/protobuf/proto"
+)
+
+// TestGRPCSyncMode checks a request's sync field overrides sync_produce both ways, as ?sync= does.
+func TestGRPCSyncMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		syncProduce bool
+		sync        *bool
+		want        bool
+	}{
+		{"left out", false, nil, false},
+		{"left out with sync_produce", true, nil, true},
+		{"opt in", false, proto.Bool(true), true},
+		{"opt out of sync_produce", true, proto.Bool(false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &grpcServer{app: &Application{conf: &internal.Config{SyncProduce: tt.syncProduce}}}
+			if got := s.syncMode(&api.PublishRequest{Sync: tt.sync}); got != tt.want {
+				t.Errorf("sync %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+)
+
+// retry routes a message Kafka failed to write again, after `produce_retry_backoff`.
+// Returns false once its retries are used up.
+// The message goes back on its key's dispatch queue in the order it failed, so the failed
+// messages of a key are retried in order. The partition is picked again: a hot key moved
+// off an unhealthy partition takes its failed messages with it.
+// The messages of the key that arrive in the meantime are held behind the retries.
+func (app *Application) retry(input kInput) bool {
+	if input.attempts >= app.conf.ProduceRetries {
+		if input.attempts > 0 {
+			app.retrySettled(input.Key)
+		}
+		return false
+	}
+	if input.attempts == 0 {
+		app.retryHolds.begin(input.Key)
+	}
+	input.attempts++
+	input.released, input.drained = false, false
+	app.metrics.ProduceRetried()
+	app.retries.push(task{
+		at: time.Now().Add(time.Duration(app.conf.ProduceRetryBackoff) * time.Millisecond),
+		run: func() {
+			app.dispatcher.Dispatch(input.Key, func() {
+				app.route(input)
+			})
+		},
+	})
+	return true
+}
+
+// produceFailed takes a partition out of rotation once Kafka failed to write to it
+// `partition_failure_threshold` times in a row.
+func (app *Application) produceFailed(partition int32) {
+	if !app.partitionMap.ProduceFailed(int(partition)) {
+		return
+	}
+	app.logger.Warn().Int32("partition", partition).Msg("partition unhealthy")
+	if !app.vanilla {
+		// The moves wait on the dispatch queues, which must not hold up sarama's errors.
+		go app.evacuate(int(partition))
+	}
+}
+
+// produceSucceeded puts a partition back in rotation once Kafka writes to it again.
+func (app *Application) produceSucceeded(partition int32) {
+	if app.partitionMap.ProduceSucceeded(int(partition)) {
+		app.logger.Info().Int32("partition", partition).Msg("partition recovered")
+	}
+}
+
+// evacuate moves the hot keys off an unhealthy partition onto healthy ones.
+// Pinned keys stay where the operator put them.
+// Each move is queued on the key's dispatch queue, like a release, so it takes effect
+// between two messages. The next message then starts a new message set on the new partition.
+// As the old partition cannot take the end of the previous set, the consumer releases
+// the new set once its reorder timeout expires.
+func (app *Application) evacuate(partition int) {
+	for _, key := range app.partitionMap.Movable(partition) {
+		key := key
+		app.dispatcher.Dispatch(key, func() {
+			dst := app.MapToPartition()
+			if move, ok := app.partitionMap.Evacuate(key, partition, dst); ok {
+				app.logger.Info().Str("key", key).Int("from", move.Src).Int("partition", move.Dst).Msg("key evacuated")
+			}
+		})
+	}
+}
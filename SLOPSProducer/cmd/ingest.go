@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+)
+
+// OpenIngestLog opens the ingest log and dispatches the messages Kafka had not acknowledged
+// when the producer stopped, in the order they were accepted.
+// It must be called once the dispatcher is started and Kafka's acknowledgements are read,
+// and before the HTTP server accepts messages.
+func (app *Application) OpenIngestLog() error {
+	ingest, replay, err := internal.OpenIngestLog(app.conf.IngestLogDir, app.conf.IngestSegmentBytes, app.conf.IngestSync)
+	if err != nil {
+		return err
+	}
+	app.ingest = ingest
+
+	for _, rec := range replay {
+		input := kInput{Key: rec.Key, Body: rec.Body, Headers: rec.Headers, seq: rec.Seq}
+		app.dispatcher.Dispatch(input.Key, func() {
+			app.route(input)
+		})
+	}
+	if len(replay) > 0 {
+		app.logger.Info().Int("messages", len(replay)).Msg("replaying ingest log")
+	}
+	return nil
+}
+
+// CheckpointIngestLog saves the acknowledgement watermark and truncates the ingest log every second.
+func (app *Application) CheckpointIngestLog(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	checkpointTicker := time.NewTicker(time.Second)
+	for range checkpointTicker.C {
+		if err := app.ingest.Checkpoint(); err != nil {
+			app.logger.Error().AnErr("checkpoint", err).Msg("ingest log checkpoint failed")
+		}
+	}
+}
+
+// ingestAck records the acknowledgement of a logged message.
+func (app *Application) ingestAck(seq uint64) {
+	if app.ingest == nil || seq == 0 {
+		return
+	}
+	app.ingest.Ack(seq)
+}
+
+// ingestFail keeps a logged message Kafka failed to write for the next start.
+// Returns false if the message was not kept.
+func (app *Application) ingestFail(input kInput) bool {
+	if app.ingest == nil || input.seq == 0 {
+		return false
+	}
+	rec := internal.IngestRecord{Seq: input.seq, Key: input.Key, Body: input.Body, Headers: input.Headers}
+	if err := app.ingest.Fail(rec); err != nil {
+		app.logger.Error().AnErr("ingest log", err).Uint64("seq", input.seq).Msg("failed message could not be kept")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"github.com/Shopify/sarama"
+)
+
+// TestIngestLogReplayBacklog restarts the producer on an ingest log holding more messages than
+// the dispatch queue and the buffers of the in-process log together. The replay must go through
+// and every message reach the log, in the order of its key.
+func TestIngestLogReplayBacklog(t *testing.T) {
+	dir := t.TempDir()
+	const messages = 2000
+	keys := []string{"a", "b", "c", "d"}
+
+	// Messages accepted before a crash, never acknowledged.
+	il, _, err := internal.OpenIngestLog(dir, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := map[string][]string{}
+	for i := 0; i < messages; i++ {
+		key := keys[i%len(keys)]
+		body := fmt.Sprintf("%s-%d", key, len(sent[key]))
+		sent[key] = append(sent[key], body)
+		if _, err := il.Append(internal.IngestRecord{Key: key, Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := il.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var conf internal.Config
+	yaml := fmt.Sprintf("transport: memory\npartitions: 3\ndispatch_workers: 1\ndispatch_queue: 4\ningest_log_dir: %s\n", dir)
+	if err := conf.Parse([]byte(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	app, err := NewApp(false, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- app.start(&sync.WaitGroup{})
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the producer did not start: the ingest log replay is stuck")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for app.ingest.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d replayed messages not acknowledged", app.ingest.Pending())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got := map[string][]string{}
+	for p := int32(0); p < conf.Partitions; p++ {
+		end, err := app.producer.broker.NewestOffset(conf.Kafka.Topic, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end == 0 {
+			continue
+		}
+		pc, err := app.producer.broker.ConsumePartition(conf.Kafka.Topic, p, sarama.OffsetOldest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for msg := range pc.Messages() {
+			got[string(msg.Key)] = append(got[string(msg.Key)], string(msg.Value))
+			if msg.Offset+1 == end {
+				break
+			}
+		}
+		pc.Close()
+	}
+	for _, key := range keys {
+		if fmt.Sprint(got[key]) != fmt.Sprint(sent[key]) {
+			t.Errorf("key %s written %d messages out of order or lost, want %d", key, len(got[key]), len(sent[key]))
+		}
+	}
+}
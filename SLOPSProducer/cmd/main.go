@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -31,79 +32,82 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// A single tracer provider is shared by every message for the lifetime of the process.
+	tp, err := TracerProvider(&conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		// Do not make the application hang when it is shutdown.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
 	wg := &sync.WaitGroup{}
 
-	app := NewApp(vanilla, &conf)
+	// LOSSY=false counts every key explicitly instead of using the configured heavy hitter backend.
+	if v := os.Getenv("LOSSY"); v != "" {
+		lossy, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !lossy {
+			conf.HeavyHitter = internal.Exact
+		}
+	}
+
+	app, err := NewApp(vanilla, &conf)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if os.Getenv("ENV") == "dev" {
 		app.logger.Level(zerolog.DebugLevel)
 	} else {
 		app.logger.Level(zerolog.InfoLevel)
 	}
+	if conf.DeadLetterTopic == "" && conf.DeadLetterFile == "" && conf.IngestLogDir == "" {
+		app.logger.Warn().Msg("no dead_letter_topic, dead_letter_file or ingest_log_dir: messages that fail every retry are dropped")
+	}
 
-	// Populate partitions in partition map.
-	app.partitionMap.PopulateMaps(int(app.conf.Partitions))
-
-	// Start the Kafka producer.
-	app.producer = app.NewProducer()
-	successes := 0
-	errors := 0
+	// Restore the saved state, start the producer and replay the ingest log.
+	if err := app.start(wg); err != nil {
+		log.Fatal(err)
+	}
 
 	// Handle signals.
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 
-	// Successes channel needs to be consumed for producer to run smoothly.
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		for s := range app.producer.kafkaProducer.Successes() {
-			// Print out timestamp, partition and offset.
-			// Later we will use this to realize total rate of messages into a partition.
-			app.logger.Info().Msgf("Received Offset: %d at time %v on partition %d", s.Offset, s.Timestamp, s.Partition)
-			successes++
-		}
-	}(wg)
-
-	// Errors channel needs to be consumed for producer to run smoothly.
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		for err := range app.producer.kafkaProducer.Errors() {
-			app.logger.Error().AnErr("Kafka Error", err)
-			errors++
-		}
-	}(wg)
-
 	// We want to track the partition weights for basic Kafka as well.
 	wg.Add(1)
-	go app.LossyCount(wg)
+	go app.TrackKeys(wg)
 
-	// And print out the weights every second.
+	// And export the weights every second.
 	wg.Add(1)
 	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
-		logTicker := time.NewTicker(time.Second)
-		for range logTicker.C {
-			partitionSizes := make([]float64, app.conf.Partitions)
-			for p := 0; p < int(app.conf.Partitions); p++ {
-				partitionSizes[p] = app.partitionMap.PartitionSize(p)
-			}
-			// app.logger.Println("Partition Weights:", partitionSizes)
-			app.logger.Debug().Str("Partition Weights:", fmt.Sprintf("%v", partitionSizes))
+		metricsTicker := time.NewTicker(time.Second)
+		for range metricsTicker.C {
+			app.metrics.SetPartitionWeights(app.partitionMap.PartitionSizes())
+			app.metrics.SetUnhealthyPartitions(int(app.conf.Partitions) - len(app.partitionMap.HealthyPartitions(int(app.conf.Partitions))))
 		}
 	}(wg)
 
 	// Swap stores if SMALOPS is being used.
 	if !app.vanilla {
 		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
-			defer wg.Done()
-			swapTicker := time.NewTicker(time.Second * time.Duration(app.conf.SwapInterval))
-			for range swapTicker.C {
-				app.partitionMap.Rebalance()
-			}
-		}(wg)
+		go app.RebalanceLoop(wg)
+	}
+
+	// gRPC Server.
+	if app.conf.GRPCPort > 0 {
+		go func() {
+			app.logger.Fatal().AnErr("gRPC server failure", app.ServeGRPC()).Msg("gRPC server stopped")
+		}()
 	}
 
 	// HTTP Server.
@@ -1,17 +1,63 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"math/rand"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/MSrvComm/SLOPSProducer/internal"
 	"github.com/gin-gonic/gin"
 )
 
 type kInput struct {
-	Key  string `json:"key"`
-	Body string `json:"body"`
+	Key       string             `json:"key"`
+	Body      string             `json:"body"`
+	Headers   map[string]string  `json:"headers,omitempty"` // Added to the Kafka record headers.
+	seq       uint64             // Sequence number in the ingest log, 0 if it is not logged.
+	result    chan produceResult // Receives the outcome in synchronous mode.
+	attempts  int                // Times Kafka failed to write the message.
+	released  bool               // Held by a drain and released, not to be held again.
+	drained   bool               // Starts a new message set after the old one drained.
+	startsSet bool               // Started a new message set when it failed, so its retry starts it too.
+	unheld    bool               // Held behind the retries of its key and released, not to be held again.
+}
+
+// Record headers set by the producer itself.
+var reservedHeaders = map[string]bool{
+	"Producer":      true,
+	"SyncEvent":     true,
+	"MsgsetDrained": true,
+	"MsgsetStart":   true,
+	"Control":       true,
+	"traceparent":   true,
+	"tracestate":    true,
+}
+
+// validate checks the headers of a message do not clash with the producer's own.
+func (in kInput) validate() error {
+	for name := range in.Headers {
+		if name == "" {
+			return errors.New("header names must not be empty")
+		}
+		if reservedHeaders[name] {
+			return fmt.Errorf("header %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (in kInput) String() string {
@@ -25,40 +71,134 @@ func (app *Application) NewMessage(c *gin.Context) {
 		app.badRequestResponse(c, err)
 		return
 	}
+	if err := input.validate(); err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	sync, err := app.syncMode(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+
+	if err := app.accept(&input, sync); err != nil {
+		app.serverErrorResponse(c, err)
+		return
+	}
+
+	app.logger.Debug().Str("Received new request:", input.String())
+	if sync {
+		app.awaitDelivery(c, input.result)
+	}
+}
+
+// syncMode reports whether a request waits for Kafka: `?sync=` if set, `sync_produce` otherwise.
+func (app *Application) syncMode(c *gin.Context) (bool, error) {
+	v := c.Query("sync")
+	if v == "" {
+		return app.conf.SyncProduce, nil
+	}
+	sync, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.New("sync must be true or false")
+	}
+	return sync, nil
+}
+
+// accept takes a message in: it samples the key for the heavy hitter detector,
+// logs the message and hands it to the key's dispatch queue.
+// In synchronous mode `input.result` receives the outcome.
+func (app *Application) accept(input *kInput, sync bool) error {
+	if sync {
+		input.result = make(chan produceResult, 1)
+	}
 
 	// Count key size.
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	if r.Float64() >= app.conf.SampleThreshold {
-		app.ch <- input.Key // Send the key to the lossy counter.
+		app.ch <- input.Key // Send the key to the heavy hitter detector.
+	}
+	// Log the message before accepting it, so it reaches Kafka even if the producer crashes.
+	if app.ingest != nil {
+		var err error
+		rec := internal.IngestRecord{Key: input.Key, Body: input.Body, Headers: input.Headers}
+		if input.seq, err = app.ingest.Append(rec); err != nil {
+			return err
+		}
 	}
 	app.logger.Debug().Msg("message sending")
+	// Hand the message to the key's ordered queue. Partition selection,
+	// message set assignment and the hand-off to sarama all happen on that queue,
+	// so messages of a key reach Kafka in the order they arrived here.
+	in := *input
+	app.dispatcher.Dispatch(in.Key, func() {
+		app.route(in)
+	})
+	return nil
+}
+
+// route picks the partition for a message and produces it.
+// It must only be called from the key's dispatch queue.
+func (app *Application) route(input kInput) {
+	// Messages of a key whose failed messages are being retried wait for them.
+	if app.retryHolds.hold(input) {
+		return
+	}
 	// Use the basic version.
 	if app.vanilla {
 		partition, err := hash(input.Key, app.conf.Partitions)
 		if err != nil {
 			app.logger.Error().AnErr(fmt.Sprintf("Kafka hashing error: %s", input.Key), err)
+			input.reply(produceResult{err: err})
 			return
 		}
 		app.logger.Printf("Kafka: Hashing new key to partition %d of %d partitions.", partition, app.conf.Partitions)
-		go app.Produce(input.Key, input.Body, partition)
+		app.Produce(input, partition)
 	} else { // Use the SLOPS algorithm.
 		var partition int32
+		var err error
 		if rec := app.partitionMap.GetKey(input.Key); rec == nil { // Use KeyMap to decide partition.
 			partition, err = hash(input.Key, app.conf.Partitions)
 			if err != nil {
 				app.logger.Error().AnErr(fmt.Sprintf("SMALOPS hashing error: %s", input.Key), err)
+				input.reply(produceResult{err: err})
 				return
 			}
+			partition = app.inRotation(partition)
 			app.logger.Printf("SMALOPS: Hashing new key to partition %d of %d partitions.", partition, app.conf.Partitions)
 		} else {
 			app.logger.Printf("SMALOPS: Sending to partition %d of %d partitions.", rec.Partition, app.conf.Partitions)
 			partition = int32(rec.Partition)
+			app.partitionMap.Touch(input.Key)
 			// Message Set header will be added by `Producer` when message is sent.
 		}
-		go app.Produce(input.Key, input.Body, partition)
+		// With the drain strategy a key switching partition waits for its old message set.
+		if app.holdForDrain(&input, partition) {
+			return
+		}
+		app.Produce(input, partition)
 	}
+}
 
-	app.logger.Debug().Str("Received new request:", input.String())
+// inRotation returns the partition if it takes traffic, otherwise the next one that does.
+// A hashed key thus starts a new message set elsewhere while its partition is unhealthy,
+// and comes back once it recovered. The partition is kept if none takes traffic.
+func (app *Application) inRotation(partition int32) int32 {
+	for i := int32(0); i < app.conf.Partitions; i++ {
+		p := (partition + i) % app.conf.Partitions
+		if app.partitionMap.Healthy(int(p)) {
+			return p
+		}
+	}
+	return partition
+}
+
+// homePartition returns the partition keys are hashed to when they are not mapped.
+func homePartition(numPartitions int32) func(key string) int32 {
+	return func(key string) int32 {
+		partition, _ := hash(key, numPartitions) // Writes to an FNV hasher do not fail.
+		return partition
+	}
 }
 
 func hash(key string, numPartitions int32) (int32, error) {
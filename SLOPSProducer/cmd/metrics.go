@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the Prometheus metrics of the producer, served on `/metrics`.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	produced         *prometheus.CounterVec   // Messages acknowledged by Kafka per partition.
+	produceErrors    *prometheus.CounterVec   // Messages Kafka failed to write per partition.
+	produceRetries   prometheus.Counter       // Failed messages routed again.
+	unhealthy        prometheus.Gauge         // Partitions out of rotation.
+	deadLetters      *prometheus.CounterVec   // Messages that failed every retry, by destination.
+	drains           *prometheus.HistogramVec // Time keys held their new message set, by outcome.
+	partitionWeights *prometheus.GaugeVec     // Size of each partition.
+	hotKeys          prometheus.Gauge         // Keys tracked by the heavy hitter detector.
+	mappedKeys       prometheus.Gauge         // Keys mapped to a partition.
+	bucket           prometheus.Gauge         // Current bucket of the heavy hitter detector.
+	migrations       prometheus.Histogram     // Flows moved per rebalance.
+	ingestLatency    *prometheus.HistogramVec // Time spent handling HTTP requests.
+}
+
+// NewMetrics registers the producer metrics on a new registry.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		produced: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slops_produce_success_total",
+			Help: "Messages acknowledged by Kafka.",
+		}, []string{"partition"}),
+		produceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slops_produce_errors_total",
+			Help: "Messages Kafka failed to write.",
+		}, []string{"partition"}),
+		produceRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "slops_produce_retries_total",
+			Help: "Messages Kafka failed to write that were routed again.",
+		}),
+		unhealthy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slops_unhealthy_partitions",
+			Help: "Partitions taken out of rotation after repeated produce errors.",
+		}),
+		deadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "slops_dead_letters_total",
+			Help: "Messages that failed every retry, written to the dead letter topic or file, or dropped.",
+		}, []string{"destination"}),
+		drains: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "slops_drain_duration_seconds",
+			Help:    "Time a migrating key held its new message set until the old one drained or the drain timed out.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"outcome"}),
+		partitionWeights: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "slops_partition_weight",
+			Help: "Total weight of the hot flows mapped to a partition.",
+		}, []string{"partition"}),
+		hotKeys: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slops_hot_keys",
+			Help: "Keys tracked by the heavy hitter detector.",
+		}),
+		mappedKeys: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slops_mapped_keys",
+			Help: "Keys mapped to a partition.",
+		}),
+		bucket: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "slops_heavy_hitter_bucket",
+			Help: "Current bucket of the heavy hitter detector.",
+		}),
+		migrations: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "slops_rebalance_migrations",
+			Help:    "Flows moved per rebalance.",
+			Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100},
+		}),
+		ingestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "slops_http_request_duration_seconds",
+			Help:    "Time spent handling HTTP requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "path", "status"}),
+	}
+	m.registry.MustRegister(
+		m.produced,
+		m.produceErrors,
+		m.produceRetries,
+		m.unhealthy,
+		m.deadLetters,
+		m.drains,
+		m.partitionWeights,
+		m.hotKeys,
+		m.mappedKeys,
+		m.bucket,
+		m.migrations,
+		m.ingestLatency,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics.
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Instrument is a middleware that records the latency of every request.
+func (m *Metrics) Instrument() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		path := c.FullPath()
+		if path == "" {
+			path = "unmatched"
+		}
+		m.ingestLatency.WithLabelValues(c.Request.Method, path, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Produced counts a message acknowledged by Kafka.
+func (m *Metrics) Produced(partition int32) {
+	m.produced.WithLabelValues(strconv.Itoa(int(partition))).Inc()
+}
+
+// ProduceError counts a message Kafka failed to write.
+func (m *Metrics) ProduceError(partition int32) {
+	m.produceErrors.WithLabelValues(strconv.Itoa(int(partition))).Inc()
+}
+
+// ProduceRetried counts a failed message that is routed again.
+func (m *Metrics) ProduceRetried() {
+	m.produceRetries.Inc()
+}
+
+// DeadLettered counts a message written to the dead letter topic or file, or dropped.
+func (m *Metrics) DeadLettered(destination string) {
+	m.deadLetters.WithLabelValues(destination).Inc()
+}
+
+// Drained records how long a migrating key held its new message set.
+func (m *Metrics) Drained(drained bool, held time.Duration) {
+	outcome := "drained"
+	if !drained {
+		outcome = "timeout"
+	}
+	m.drains.WithLabelValues(outcome).Observe(held.Seconds())
+}
+
+// SetUnhealthyPartitions records the number of partitions out of rotation.
+func (m *Metrics) SetUnhealthyPartitions(n int) {
+	m.unhealthy.Set(float64(n))
+}
+
+// SetPartitionWeights records the size of every partition.
+func (m *Metrics) SetPartitionWeights(sizes map[int]float64) {
+	for p, size := range sizes {
+		m.partitionWeights.WithLabelValues(strconv.Itoa(p)).Set(size)
+	}
+}
+
+// EndBucket records the state of the heavy hitter detector at the end of a bucket.
+func (m *Metrics) EndBucket(bucket, hotKeys, mappedKeys int) {
+	m.bucket.Set(float64(bucket))
+	m.hotKeys.Set(float64(hotKeys))
+	m.mappedKeys.Set(float64(mappedKeys))
+}
+
+// Rebalanced records the number of flows moved by a rebalance.
+func (m *Metrics) Rebalanced(moves int) {
+	m.migrations.Observe(float64(moves))
+}
@@ -4,62 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
-	"fmt"
 	"log"
 	"os"
-	"time"
 
+	broker "github.com/MSrvComm/SLOPSBroker"
 	"github.com/MSrvComm/SLOPSProducer/internal"
 	"github.com/Shopify/sarama"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/Shopify/sarama/otelsarama"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-
-	"go.opentelemetry.io/otel/exporters/jaeger"
-	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
-
 	"go.opentelemetry.io/otel/propagation"
-	"go.opentelemetry.io/otel/sdk/resource"
-	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-func TracerProvider() (*sdktrace.TracerProvider, error) {
-	url := os.Getenv("TRACER_COLLECTOR")
-	// Create Jaeger exporter.
-	exp, err := jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(url)))
-	if err != nil {
-		return nil, err
-	}
-	svcName := os.Getenv("TRACER_NAME")
-	tp := sdktrace.NewTracerProvider(
-		sdktrace.WithBatcher(exp),
-		sdktrace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceNameKey.String(svcName),
-			attribute.String("exporter", "jaeger"),
-		)),
-	)
-	otel.SetTracerProvider(tp)
-	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}))
-	return tp, nil
-}
-
-func (app *Application) getProdConfig() *sarama.Config {
-	// sarama logging to stdout.
-	sarama.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Llongfile)
-
-	// producer config
-	config := sarama.NewConfig()
-	config.Producer.Retry.Max = 5
-	config.Producer.RequiredAcks = sarama.WaitForLocal
-	config.Producer.Compression = sarama.CompressionSnappy // Compress messages
-	config.Producer.Return.Successes = true
-	config.Producer.Flush.Frequency = 500 * time.Millisecond // Flush batches every 500ms
-	config.ClientID = os.Getenv("ADDRESS")
-	config.Producer.Partitioner = sarama.NewManualPartitioner
-	return config
-}
-
 // SysDetails will hold const values required to run the system
 // instead of defining them as constants.
 type SysDetails struct {
@@ -67,10 +23,10 @@ type SysDetails struct {
 	kafkaTopic   string
 }
 
-func NewSysDetails() SysDetails {
+func NewSysDetails(conf *internal.KafkaConfig) SysDetails {
 	return SysDetails{
-		kafkaBrokers: []string{os.Getenv("KAFKA_BOOTSTRAP")},
-		kafkaTopic:   "OrderGo",
+		kafkaBrokers: conf.Brokers,
+		kafkaTopic:   conf.Topic,
 	}
 }
 
@@ -91,57 +47,41 @@ func NewEnvVar() EnvVar {
 type Producer struct {
 	envVar        EnvVar
 	sysDetails    SysDetails
-	kafkaConfig   *sarama.Config
-	kafkaProducer sarama.AsyncProducer
+	broker        broker.Broker   // Kafka or the in-process log.
+	kafkaProducer broker.Producer // Writes to the broker.
 }
 
 func (app *Application) NewProducer() Producer {
-	envVar := NewEnvVar()
-	sysDetails := NewSysDetails()
+	// sarama logging to stdout.
+	sarama.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lmicroseconds|log.Llongfile)
 
-	config := app.getProdConfig()
+	envVar := NewEnvVar()
+	sysDetails := NewSysDetails(&app.conf.Kafka)
 
-	kafkaProducer, err := sarama.NewAsyncProducer(sysDetails.kafkaBrokers, config)
-	propagators := propagation.TraceContext{}
-	// Wrap instrumentation
-	kafkaProducer = otelsarama.WrapAsyncProducer(
-		config,
-		kafkaProducer,
-		otelsarama.WithTracerProvider(otel.GetTracerProvider()),
-		otelsarama.WithPropagators(propagators),
-	)
+	broker, err := internal.NewBroker(app.conf)
 	if err != nil {
-		app.logger.Error().AnErr("Error creating producer", err)
+		app.logger.Fatal().AnErr("broker", err).Msg("cannot connect to the " + app.conf.Transport + " transport")
+	}
+	kafkaProducer, err := broker.NewProducer()
+	if err != nil {
+		app.logger.Fatal().AnErr("Error creating producer", err).Msg("cannot create the producer")
 	}
-	app.logger.Debug().Msg(fmt.Sprintf("propogators: %v\n", kafkaProducer))
 
 	return Producer{
 		envVar:        envVar,
 		sysDetails:    sysDetails,
-		kafkaConfig:   config,
+		broker:        broker,
 		kafkaProducer: kafkaProducer,
 	}
 }
 
-func (app *Application) Produce(key, msg string, partition int32) {
-	tp, tperr := TracerProvider()
-	if tperr != nil {
-		log.Fatal(tperr)
-	}
-
-	// Cleanly shutdown and flush telemetry when the application exits.
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	defer func(ctx context.Context) {
-		// Do not make the application hang when it is shutdown.
-		ctx, cancel = context.WithTimeout(ctx, time.Second*5)
-		defer cancel()
-		if err := tp.Shutdown(ctx); err != nil {
-			log.Fatal(err)
-		}
-	}(ctx)
-
+// Produce builds the Kafka message for a key and hands it to sarama.
+// It runs on the key's dispatch queue, which keeps message set assignment
+// and the writes to `Input()` in per-key arrival order.
+func (app *Application) Produce(input kInput, partition int32) {
 	var kmsg *sarama.ProducerMessage
+	key, msg := input.Key, input.Body
+	d := &delivery{input: input, msgsetIndex: -1}
 
 	hdrs := []sarama.RecordHeader{
 		{
@@ -149,6 +89,9 @@ func (app *Application) Produce(key, msg string, partition int32) {
 			Value: []byte(app.producer.envVar.containerIP),
 		},
 	}
+	for _, name := range sortedKeys(input.Headers) {
+		hdrs = append(hdrs, sarama.RecordHeader{Key: []byte(name), Value: []byte(input.Headers[name])})
+	}
 
 	// When Kafka is used.
 	if app.vanilla {
@@ -167,6 +110,7 @@ func (app *Application) Produce(key, msg string, partition int32) {
 		err := enc.Encode(msgset)
 		if err != nil {
 			app.logger.Error().AnErr("Encoding err", err)
+			input.reply(produceResult{err: err})
 			return
 		}
 		msgsetHdr := sarama.RecordHeader{
@@ -174,30 +118,43 @@ func (app *Application) Produce(key, msg string, partition int32) {
 			Value: msgsetHdrVal.Bytes(),
 		}
 		hdrs = append(hdrs, msgsetHdr)
-
-		// Send a message to the older partition that the message set has ended.
+		d.msgsetIndex = msgset.DestMsgsetIndex
+		d.migrated = partitionchanged
+		header := *msgset
+		d.msgset = &header
+
+		// The message goes to its new partition. The older partition receives a control record
+		// that ends the previous message set.
+		// An unhealthy partition cannot take it: the consumer then releases the new set
+		// once its reorder timeout expires.
+		// After a drain the old set is complete: the message itself tells the consumer the old set ended.
+		// Only the first message of a set waits for the previous set on the consumers.
+		if partitionchanged || input.startsSet {
+			hdrs = append(hdrs, sarama.RecordHeader{Key: []byte("MsgsetStart"), Value: []byte("true")})
+		}
 		if partitionchanged {
-			kmsg = &sarama.ProducerMessage{
-				Topic:     app.producer.sysDetails.kafkaTopic,
-				Key:       sarama.StringEncoder(key),
-				Value:     sarama.StringEncoder(msg),
-				Headers:   hdrs,
-				Partition: msgset.SrcPartition,
-			}
 			app.logger.Printf("Key %s switching to %d from %d\n", key, msgset.DestPartition, msgset.SrcPartition)
-		} else {
-			kmsg = &sarama.ProducerMessage{
-				Topic:     app.producer.sysDetails.kafkaTopic,
-				Key:       sarama.StringEncoder(key),
-				Value:     sarama.StringEncoder(msg),
-				Headers:   hdrs,
-				Partition: partition,
+			if input.drained {
+				hdrs = append(hdrs, sarama.RecordHeader{Key: []byte("MsgsetDrained"), Value: []byte("true")})
+			} else if app.partitionMap.Healthy(int(msgset.SrcPartition)) {
+				app.endMsgset(key, msgset.SrcPartition, msgsetHdr)
 			}
 		}
+		kmsg = &sarama.ProducerMessage{
+			Topic:     app.producer.sysDetails.kafkaTopic,
+			Key:       sarama.StringEncoder(key),
+			Value:     sarama.StringEncoder(msg),
+			Headers:   hdrs,
+			Partition: partition,
+		}
 	}
 
+	// Match the acknowledgement with the ingest log and the waiting request,
+	// and keep the message to retry it if Kafka fails to write it.
+	kmsg.Metadata = d
+
 	// Create root span
-	tr := tp.Tracer("producer")
+	tr := otel.Tracer("producer")
 	ctx, span := tr.Start(context.Background(), "produce message")
 	defer span.End()
 
@@ -206,10 +163,42 @@ func (app *Application) Produce(key, msg string, partition int32) {
 	// Add the key as a Jaeger tag.
 	span.SetAttributes(attribute.String("producer.key", key))
 
+	if app.drains != nil {
+		app.drains.sent(key)
+	}
 	app.producer.kafkaProducer.Input() <- kmsg
 	app.logger.Info().Int32("message sent on partition", kmsg.Partition)
 }
 
+// controlEndOfSet is the `Control` header of the record that ends a message set.
+const controlEndOfSet = "EndOfSet"
+
+// controlRecord travels with a control record through sarama in `ProducerMessage.Metadata`.
+type controlRecord struct {
+	key       string
+	partition int32
+}
+
+// endMsgset writes the control record that ends the previous message set of a key on its old partition.
+// It carries the message set header of the switch and no payload. Consumers process the
+// messages before it, end the set and skip the record.
+func (app *Application) endMsgset(key string, src int32, msgsetHdr sarama.RecordHeader) {
+	if app.drains != nil {
+		app.drains.sent(key)
+	}
+	app.producer.kafkaProducer.Input() <- &sarama.ProducerMessage{
+		Topic: app.producer.sysDetails.kafkaTopic,
+		Key:   sarama.StringEncoder(key),
+		Headers: []sarama.RecordHeader{
+			{Key: []byte("Producer"), Value: []byte(app.producer.envVar.containerIP)},
+			msgsetHdr,
+			{Key: []byte("Control"), Value: []byte(controlEndOfSet)},
+		},
+		Partition: src,
+		Metadata:  &controlRecord{key: key, partition: src},
+	}
+}
+
 // Create and send message set header
 func (app *Application) MsgsetHdrVal(key string, partition int32) (*internal.MessageSet, bool) {
 	var msgset *internal.MessageSet
@@ -225,7 +214,7 @@ func (app *Application) MsgsetHdrVal(key string, partition int32) (*internal.Mes
 			DestPartition:   partition,
 			DestMsgsetIndex: 0,
 		}
-		go app.messageSets.AddKey(*msgset)
+		app.messageSets.AddKey(*msgset)
 	} else {
 		if lastmsgset.DestPartition == partition {
 			// If we are still sending to the same partition,
@@ -245,7 +234,7 @@ func (app *Application) MsgsetHdrVal(key string, partition int32) (*internal.Mes
 	}
 
 	if partitionChanged {
-		go app.messageSets.AddKey(*msgset)
+		app.messageSets.AddKey(*msgset)
 	}
 
 	return msgset, partitionChanged
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"github.com/gin-gonic/gin"
+)
+
+// RebalanceLoop plans a rebalance every round.
+// In auto mode the plan is applied right away, in manual mode it is queued for approval.
+func (app *Application) RebalanceLoop(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	swapTicker := time.NewTicker(app.conf.RebalanceEvery())
+	for range swapTicker.C {
+		plan := app.partitionMap.Plan(app.conf.Rebalancer, app.rebalancer)
+		if app.conf.RebalanceMode == internal.RebalanceManual {
+			if len(plan.Moves) == 0 {
+				continue
+			}
+			id, queued := app.plans.AddNew(plan)
+			if !queued {
+				continue
+			}
+			app.logger.Info().Int64("plan", id).Int("moves", len(plan.Moves)).Str("rebalancer", app.conf.Rebalancer).Msg("rebalance plan queued")
+			continue
+		}
+		moves := app.partitionMap.Apply(plan)
+		app.metrics.Rebalanced(len(moves))
+		if len(moves) > 0 {
+			app.logger.Info().Int("moves", len(moves)).Str("rebalancer", app.conf.Rebalancer).Msg("rebalanced partitions")
+		}
+	}
+}
+
+// DryRunPlan returns the plan the rebalancer would apply now, without applying it.
+func (app *Application) DryRunPlan(c *gin.Context) {
+	plan := app.partitionMap.Plan(app.conf.Rebalancer, app.rebalancer)
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"plan": plan}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// PendingPlans lists the plans waiting for approval.
+func (app *Application) PendingPlans(c *gin.Context) {
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"plans": app.plans.Pending()}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// QueuePlan computes a plan and queues it for approval.
+func (app *Application) QueuePlan(c *gin.Context) {
+	plan := app.partitionMap.Plan(app.conf.Rebalancer, app.rebalancer)
+	app.plans.Add(plan)
+	if err := app.writeJSON(c.Writer, http.StatusCreated, envelope{"plan": plan}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// ShowPlan returns a pending plan.
+func (app *Application) ShowPlan(c *gin.Context) {
+	id, err := app.readPlanID(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	plan, err := app.plans.Get(id)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"plan": plan}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// ApplyPlan applies a pending plan.
+// Moves whose flow changed partition since the plan was made are skipped.
+func (app *Application) ApplyPlan(c *gin.Context) {
+	id, err := app.readPlanID(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	plan, err := app.plans.Take(id)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	plan.Applied = app.partitionMap.Apply(plan)
+	app.metrics.Rebalanced(len(plan.Applied))
+	plan.Status = internal.PlanApplied
+	app.logger.Info().Int64("plan", id).Int("moves", len(plan.Applied)).Msg("rebalance plan applied")
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"plan": plan}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+// RejectPlan discards a pending plan.
+func (app *Application) RejectPlan(c *gin.Context) {
+	id, err := app.readPlanID(c)
+	if err != nil {
+		app.badRequestResponse(c, err)
+		return
+	}
+	plan, err := app.plans.Take(id)
+	if err != nil {
+		app.notFoundResponse(c)
+		return
+	}
+	plan.Status = internal.PlanRejected
+	app.logger.Info().Int64("plan", id).Msg("rebalance plan rejected")
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"plan": plan}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
+
+func (app *Application) readPlanID(c *gin.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid plan id")
+	}
+	return id, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import "sync"
+
+// retryHolds keeps the messages of a key behind its failed ones: from the moment Kafka
+// rejects a message of a key until every retry of the key was acknowledged or given up,
+// the new messages of the key are held and routed after the retries, in order.
+// Messages that were already handed to sarama when the failure came back cannot be held,
+// so they still get ahead of the failed message.
+type retryHolds struct {
+	mu    sync.Mutex
+	holds map[string]*retryHold
+}
+
+// retryHold is a key waiting for the retries of its failed messages.
+type retryHold struct {
+	retries int      // Failed messages of the key that are being retried.
+	held    []kInput // Messages of the key that arrived since, in order.
+	ending  bool     // The retries settled and the release is queued.
+}
+
+func newRetryHolds() *retryHolds {
+	return &retryHolds{holds: map[string]*retryHold{}}
+}
+
+// begin records that a failed message of a key is being retried.
+func (rh *retryHolds) begin(key string) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	h, ok := rh.holds[key]
+	if !ok {
+		h = &retryHold{}
+		rh.holds[key] = h
+	}
+	// A release that is already queued waits for this retry too.
+	h.ending = false
+	h.retries++
+}
+
+// settle records that a retried message was acknowledged or given up on.
+// Returns true once the last retry of the key settled, so the held messages can be released.
+func (rh *retryHolds) settle(key string) bool {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	h, ok := rh.holds[key]
+	if !ok || h.retries == 0 {
+		return false
+	}
+	h.retries--
+	if h.retries > 0 {
+		return false
+	}
+	h.ending = true
+	return true
+}
+
+// hold adds a message to the hold of its key. Returns false if the key is not held.
+// Retried messages are never held: they are the ones the others wait for.
+func (rh *retryHolds) hold(input kInput) bool {
+	if input.attempts > 0 || input.unheld {
+		return false
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	h, ok := rh.holds[input.Key]
+	if ok {
+		h.held = append(h.held, input)
+	}
+	return ok
+}
+
+// finish ends the hold of a key and returns the held messages,
+// unless a new retry of the key started in the meantime.
+func (rh *retryHolds) finish(key string) ([]kInput, bool) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	h, ok := rh.holds[key]
+	if !ok || !h.ending {
+		return nil, false
+	}
+	delete(rh.holds, key)
+	return h.held, true
+}
+
+// retrySettled handles the acknowledgement or the last failure of a retried message.
+// Once every retry of the key settled, the held messages are routed on the key's dispatch
+// queue. Messages dispatched before the release are still held, so the key keeps its order.
+func (app *Application) retrySettled(key string) {
+	if !app.retryHolds.settle(key) {
+		return
+	}
+	// The release waits on the dispatch queue, which must not hold up sarama's results.
+	go app.dispatcher.Dispatch(key, func() {
+		held, ok := app.retryHolds.finish(key)
+		if !ok {
+			return
+		}
+		for _, input := range held {
+			input.unheld = true
+			app.route(input)
+		}
+	})
+}
@@ -10,8 +10,31 @@ func (app *Application) routes() *gin.Engine {
 	router.NoRoute(app.notFoundResponse)
 	router.NoMethod(app.methodNotAllowedResponse)
 	router.HandleMethodNotAllowed = true
+	router.Use(app.metrics.Instrument())
+
+	router.GET("/metrics", app.metrics.Handler())
 
 	router.POST("/new", app.NewMessage)
+	router.POST("/batch", app.NewBatch)
+
+	router.GET("/partitions", app.ShowPartitions)
+	router.GET("/partitions/:partition", app.ShowPartition)
+	router.GET("/sizes", app.ShowSizes)
+	router.GET("/hotkeys", app.ShowHotKeys)
+	router.GET("/keys/:key", app.ShowKey)
+	router.GET("/state", app.ShowState)
+	router.POST("/keys/:key/pin", app.PinKey)
+	router.DELETE("/keys/:key/pin", app.UnpinKey)
+	router.POST("/keys/:key/migrate", app.MigrateKey)
+
+	router.GET("/rebalance/plan", app.DryRunPlan)
+	router.GET("/rebalance/plans", app.PendingPlans)
+	router.POST("/rebalance/plans", app.QueuePlan)
+	router.GET("/rebalance/plans/:id", app.ShowPlan)
+	router.POST("/rebalance/plans/:id/apply", app.ApplyPlan)
+	router.DELETE("/rebalance/plans/:id", app.RejectPlan)
+
+	router.POST("/deadletters/replay", app.ReplayDeadLetters)
 
 	return router
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"github.com/gin-gonic/gin"
+)
+
+// RestoreState puts back the partition map and the message sets saved before a restart.
+// Without saved state the seed file, if any, prepares the partition map.
+// With `state_dir` set every later change is journaled there.
+// It must be called before the producer accepts messages.
+func (app *Application) RestoreState() error {
+	var state *internal.State
+	if app.conf.StateDir != "" {
+		store, err := internal.OpenStateStore(app.conf.StateDir)
+		if err != nil {
+			return err
+		}
+		app.state = store
+		if state, err = store.Load(); err != nil {
+			return err
+		}
+		if state != nil {
+			app.logger.Info().Str("dir", app.conf.StateDir).Int("keys", len(state.Keys)).Int("msgsets", len(state.MessageSets)).Msg("state restored")
+		}
+	}
+	if state == nil && app.conf.StateSeed != "" {
+		seed, err := internal.ReadState(app.conf.StateSeed)
+		if err != nil {
+			return err
+		}
+		state = seed
+		app.logger.Info().Str("seed", app.conf.StateSeed).Int("keys", len(state.Keys)).Msg("partition map seeded")
+	}
+
+	if state != nil {
+		if state.Partitions != 0 && state.Partitions != app.conf.Partitions {
+			return fmt.Errorf("state was saved with %d partitions, %d are configured", state.Partitions, app.conf.Partitions)
+		}
+		if err := app.partitionMap.Restore(state.Keys); err != nil {
+			return err
+		}
+		app.messageSets.Restore(state.MessageSets)
+	}
+
+	if app.state != nil {
+		app.partitionMap.SetJournal(mapJournal{Journal: app.state, messageSets: app.messageSets})
+		app.messageSets.SetJournal(app.state)
+		// Start from a fresh snapshot, which also persists an imported seed.
+		return app.state.Snapshot(app.captureState)
+	}
+	return nil
+}
+
+// mapJournal journals the changes to the partition map. The message set of a key that was not
+// persisted, its first one on its home partition, is journaled before the key is mapped.
+type mapJournal struct {
+	internal.Journal
+	messageSets *internal.MessageSetMap
+}
+
+func (j mapJournal) Append(entry internal.JournalEntry) {
+	if entry.Op == internal.OpMap {
+		j.messageSets.Persist(entry.Key)
+	}
+	j.Journal.Append(entry)
+}
+
+// captureState returns the current state.
+func (app *Application) captureState() *internal.State {
+	return &internal.State{
+		TakenAt:     time.Now(),
+		Partitions:  app.conf.Partitions,
+		Keys:        app.partitionMap.Records(),
+		MessageSets: app.messageSets.Records(),
+	}
+}
+
+// SnapshotLoop snapshots the state every `snapshot_interval` seconds.
+func (app *Application) SnapshotLoop(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	snapshotTicker := time.NewTicker(time.Duration(app.conf.SnapshotInterval * float64(time.Second)))
+	for range snapshotTicker.C {
+		if err := app.state.Snapshot(app.captureState); err != nil {
+			app.logger.Error().AnErr("snapshot", err).Msg("state snapshot failed")
+		}
+	}
+}
+
+// ShowState returns the current state in the snapshot format, which can be used as a seed file.
+func (app *Application) ShowState(c *gin.Context) {
+	if err := app.writeJSON(c.Writer, http.StatusOK, envelope{"state": app.captureState()}, nil); err != nil {
+		app.serverErrorResponse(c, err)
+	}
+}
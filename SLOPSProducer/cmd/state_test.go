@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+)
+
+// TestRestoreMappedKey crashes the producer after a key on its home partition was mapped
+// elsewhere, before its next message. After the restart the key must still know the message set
+// it left on its home partition, so its next message ends that set instead of starting over.
+func TestRestoreMappedKey(t *testing.T) {
+	var conf internal.Config
+	yaml := fmt.Sprintf("transport: memory\npartitions: 3\nstate_dir: %s\n", t.TempDir())
+	if err := conf.Parse([]byte(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	restart := func() *Application {
+		app, err := NewApp(false, &conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.partitionMap.PopulateMaps(int(conf.Partitions))
+		if err := app.RestoreState(); err != nil {
+			t.Fatal(err)
+		}
+		return app
+	}
+
+	app := restart()
+	const key = "k"
+	home := homePartition(conf.Partitions)(key)
+	app.MsgsetHdrVal(key, home) // The first message of the key.
+	app.partitionMap.AddKey(key, 1, 1, int(home+1)%int(conf.Partitions))
+
+	app = restart()
+	msgset, err := app.messageSets.GetKey(key)
+	if err != nil {
+		t.Fatalf("message set lost: %v", err)
+	}
+	if msgset.DestPartition != home || msgset.DestMsgsetIndex != 0 {
+		t.Errorf("restored message set %d on partition %d, want 0 on %d", msgset.DestMsgsetIndex, msgset.DestPartition, home)
+	}
+	next, switched := app.MsgsetHdrVal(key, int32(app.partitionMap.GetKey(key).Partition))
+	if !switched || next.DestMsgsetIndex != 1 || next.SrcPartition != home {
+		t.Errorf("next message set %+v, want set 1 ending set 0 on %d", next, home)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// task is work taken off sarama's Successes and Errors loops.
+type task struct {
+	at  time.Time // The task does not run before then.
+	run func()
+}
+
+// taskQueue runs tasks one at a time, in the order they were pushed.
+// Pushing never blocks, so sarama's results keep flowing while a task waits
+// on a full dispatch queue or on sarama's input.
+type taskQueue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	items []task
+}
+
+func newTaskQueue() *taskQueue {
+	q := &taskQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *taskQueue) push(t task) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, t)
+	q.cond.Signal()
+}
+
+// pop waits for the oldest task.
+func (q *taskQueue) pop() task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	t := q.items[0]
+	q.items[0] = task{}
+	q.items = q.items[1:]
+	return t
+}
+
+// Run runs the tasks as they are pushed.
+func (q *taskQueue) Run(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		t := q.pop()
+		time.Sleep(time.Until(t.at))
+		t.run()
+	}
+}
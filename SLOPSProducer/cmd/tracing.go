@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/MSrvComm/SLOPSProducer/internal"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// TracerProvider creates the tracer provider of the process with the exporter selected in the configuration.
+// It is created once at startup; the producer, otelsarama included, gets it from `otel.GetTracerProvider`.
+func TracerProvider(conf *internal.Config) (*sdktrace.TracerProvider, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}))
+
+	exp, err := newSpanExporter(conf)
+	if err != nil {
+		return nil, err
+	}
+	// The producer starts the traces, so the ratio decides which messages are traced end to end.
+	sampler := sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.TraceSampleRatio))
+	if exp == nil {
+		// Nothing is exported, so spans are not even recorded.
+		sampler = sdktrace.NeverSample()
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(os.Getenv("TRACER_NAME")),
+			attribute.String("exporter", conf.Tracer),
+		)),
+	}
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return tp, nil
+}
+
+// newSpanExporter returns the exporter selected in the configuration, nil for `none`.
+// The endpoint defaults to TRACER_COLLECTOR.
+func newSpanExporter(conf *internal.Config) (sdktrace.SpanExporter, error) {
+	endpoint := conf.TracerEndpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("TRACER_COLLECTOR")
+	}
+
+	switch conf.Tracer {
+	case internal.TracerNone:
+		return nil, nil
+	case internal.TracerJaeger:
+		return jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(endpoint)))
+	case internal.TracerOTLPGRPC:
+		opts := make([]otlptracegrpc.Option, 0)
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if conf.TracerInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(context.Background(), opts...)
+	case internal.TracerOTLPHTTP:
+		opts := make([]otlptracehttp.Option, 0)
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if conf.TracerInsecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	case internal.TracerStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown tracer %q", conf.Tracer)
+	}
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+
+	broker "github.com/MSrvComm/SLOPSBroker"
+	"github.com/Shopify/sarama"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/Shopify/sarama/otelsarama"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Transports.
+const (
+	TransportKafka  = "kafka"
+	TransportMemory = "memory"
+)
+
+// NewBroker returns the transport selected in the configuration.
+func NewBroker(conf *Config) (broker.Broker, error) {
+	switch conf.Transport {
+	case TransportKafka:
+		config, err := conf.Kafka.Sarama()
+		if err != nil {
+			return nil, err
+		}
+		kb, err := broker.NewKafkaBroker(conf.Kafka.Brokers, config)
+		if err != nil {
+			return nil, err
+		}
+		return tracedBroker{kb}, nil
+	case TransportMemory:
+		return broker.NewMemoryBroker(conf.Partitions, conf.MemoryRetention), nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", conf.Transport)
+	}
+}
+
+// tracedBroker is a Kafka cluster whose producers trace the messages with otelsarama.
+type tracedBroker struct {
+	*broker.KafkaBroker
+}
+
+// NewProducer implements broker.Broker.
+func (tb tracedBroker) NewProducer() (broker.Producer, error) {
+	client := tb.Client()
+	producer, err := sarama.NewAsyncProducerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	return otelsarama.WrapAsyncProducer(
+		client.Config(),
+		producer,
+		otelsarama.WithTracerProvider(otel.GetTracerProvider()),
+		otelsarama.WithPropagators(propagation.TraceContext{}),
+	), nil
+}
@@ -1,6 +1,11 @@
 package internal
 
-import "gopkg.in/yaml.v2"
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
 
 type Config struct {
 	Service         string  `yaml:"service"`
@@ -10,8 +15,235 @@ type Config struct {
 	Partitions      int32   `yaml:"partitions"`
 	HTTPPort        int     `yaml:"http_port"`
 	SwapInterval    int     `yaml:"swap_interval"`
+	DispatchWorkers int     `yaml:"dispatch_workers"` // Number of ordered dispatch queues.
+	DispatchQueue   int     `yaml:"dispatch_queue"`   // Capacity of each dispatch queue.
+	DecayHalfLife   float64 `yaml:"decay_half_life"`  // Half-life of flow weights in seconds.
+	DemotionIdle    float64 `yaml:"demotion_idle"`    // Seconds a demoted key stays on its partition after its last message, 0 to release it at once.
+
+	HeavyHitter         string `yaml:"heavy_hitter"`          // Heavy hitter backend: lossy, space-saving, count-min or exact.
+	HeavyHitterCapacity int    `yaml:"heavy_hitter_capacity"` // Keys tracked by space-saving and count-min, 1/epsilon if unset.
+	CMSWidth            int    `yaml:"cms_width"`             // Counters per count-min row, e/epsilon if unset.
+	CMSDepth            int    `yaml:"cms_depth"`             // Count-min rows.
+	ExactWindow         int    `yaml:"exact_window"`          // Buckets counted by the exact counter.
+
+	Rebalancer         string  `yaml:"rebalancer"`          // Rebalancing strategy: greedy, tolerance, state-tracking, state-tracking-tol or lpt.
+	RebalanceTolerance float64 `yaml:"rebalance_tolerance"` // Imbalance, as a fraction of the average partition size, that is tolerated.
+	RebalanceSleep     int     `yaml:"rebalance_sleep"`     // Milliseconds between rounds of the state-tracking strategies.
+	StateHold          float64 `yaml:"state_hold"`          // Seconds a flow moved by the state-tracking strategies is left alone by them, 0 to disable.
+	RebalanceMode      string  `yaml:"rebalance_mode"`      // auto applies plans right away, manual queues them for approval.
+	PendingPlans       int     `yaml:"pending_plans"`       // Plans kept for approval in manual mode.
+	MigrationCooldown  float64 `yaml:"migration_cooldown"`  // Seconds a moved flow is left alone by the rebalancer, 0 to disable.
+	FlapThreshold      int     `yaml:"flap_threshold"`      // Moves within flap_window that flag a flow as flapping, 0 to disable.
+	FlapWindow         float64 `yaml:"flap_window"`         // Seconds over which moves are counted for flapping.
+	FlapHold           float64 `yaml:"flap_hold"`           // Seconds a flapping flow is held in place.
+
+	StateDir         string  `yaml:"state_dir"`         // Directory of the snapshot and write-ahead log, state is not persisted if unset.
+	SnapshotInterval float64 `yaml:"snapshot_interval"` // Seconds between snapshots.
+	StateSeed        string  `yaml:"state_seed"`        // Snapshot file that seeds the partition map when there is no saved state.
+
+	IngestLogDir       string `yaml:"ingest_log_dir"`       // Directory of the ingest log, accepted messages are not logged if unset.
+	IngestSegmentBytes int64  `yaml:"ingest_segment_bytes"` // Size of an ingest log segment.
+	IngestSync         bool   `yaml:"ingest_sync"`          // Sync every accepted message to disk, not just to the OS.
+
+	SyncProduce bool `yaml:"sync_produce"` // Answer POST /new once Kafka acknowledged the message, unless the request sets ?sync=false.
+	SyncTimeout int  `yaml:"sync_timeout"` // Milliseconds a synchronous request waits for Kafka.
+
+	BatchMaxBytes int64 `yaml:"batch_max_bytes"` // Largest body accepted by POST /batch.
+	GRPCPort      int   `yaml:"grpc_port"`       // Port of the gRPC ingest service, disabled if unset.
+
+	Tracer           string  `yaml:"tracer"`             // Span exporter: otlp-grpc, otlp-http, jaeger, stdout or none.
+	TracerEndpoint   string  `yaml:"tracer_endpoint"`    // Collector of the exporter, TRACER_COLLECTOR if unset.
+	TracerInsecure   bool    `yaml:"tracer_insecure"`    // Send OTLP spans without TLS.
+	TraceSampleRatio float64 `yaml:"trace_sample_ratio"` // Fraction of the messages traced, from 0 to 1.
+
+	PartitionFailureThreshold int     `yaml:"partition_failure_threshold"` // Consecutive produce errors that take a partition out of rotation.
+	PartitionRecovery         float64 `yaml:"partition_recovery"`          // Seconds after its last error an unhealthy partition is tried again.
+	ProduceRetries            int     `yaml:"produce_retries"`             // Times a message Kafka failed to write is routed again, 0 to never retry.
+	ProduceRetryBackoff       int     `yaml:"produce_retry_backoff"`       // Milliseconds before a failed message is routed again.
+	DeadLetterTopic           string  `yaml:"dead_letter_topic"`           // Topic of the messages that failed every retry, written to partition 0.
+	DeadLetterFile            string  `yaml:"dead_letter_file"`            // File of the dead letters the topic could not take.
+
+	MigrationStrategy string `yaml:"migration_strategy"` // reorder switches partition at once, drain holds the new message set until the old one drained.
+	DrainGroup        string `yaml:"drain_group"`        // Consumer group that must commit the old message set before a drain ends, acknowledgements only if unset.
+	DrainTimeout      int    `yaml:"drain_timeout"`      // Milliseconds a drain waits before falling back to reorder.
+
+	Transport       string      `yaml:"transport"`        // Log the messages are written to: kafka or memory, an in-process log.
+	MemoryRetention int         `yaml:"memory_retention"` // Messages kept per partition by the memory transport.
+	Kafka           KafkaConfig `yaml:"kafka"`
 }
 
+// unset marks the settings for which 0 is a valid value until the config file is read,
+// so they are only defaulted when they were left out.
+const unset = -1
+
 func (c *Config) Parse(data []byte) error {
-	return yaml.Unmarshal(data, c)
+	c.MigrationCooldown = unset
+	c.FlapThreshold = unset
+	c.StateHold = unset
+	c.TraceSampleRatio = unset
+	c.Kafka.Retries = unset
+	c.ProduceRetries = unset
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return err
+	}
+	c.setDefaults()
+	return c.validate()
+}
+
+// validate rejects the settings that are out of range.
+func (c *Config) validate() error {
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return fmt.Errorf("trace_sample_ratio %v is not between 0 and 1", c.TraceSampleRatio)
+	}
+	return nil
+}
+
+// setDefaults fills in the optional settings that were left out of the config file.
+func (c *Config) setDefaults() {
+	if c.DispatchWorkers <= 0 {
+		c.DispatchWorkers = 16
+	}
+	if c.DispatchQueue <= 0 {
+		c.DispatchQueue = 1024
+	}
+	if c.DecayHalfLife <= 0 {
+		c.DecayHalfLife = 30
+	}
+	if c.HeavyHitter == "" {
+		c.HeavyHitter = LossyCounting
+	}
+	if c.CMSDepth <= 0 {
+		c.CMSDepth = 4
+	}
+	if c.ExactWindow <= 0 {
+		c.ExactWindow = 10
+	}
+	if c.Rebalancer == "" {
+		c.Rebalancer = GreedyRebalancer
+	}
+	if c.RebalanceTolerance <= 0 {
+		c.RebalanceTolerance = 0.1
+	}
+	if c.MigrationCooldown < 0 {
+		c.MigrationCooldown = 10
+	}
+	if c.RebalanceSleep <= 0 {
+		c.RebalanceSleep = 100
+	}
+	if c.StateHold < 0 {
+		c.StateHold = 10
+	}
+	if c.RebalanceMode == "" {
+		c.RebalanceMode = RebalanceAuto
+	}
+	if c.PendingPlans <= 0 {
+		c.PendingPlans = 16
+	}
+	if c.FlapThreshold < 0 {
+		c.FlapThreshold = 3
+	}
+	if c.FlapWindow <= 0 {
+		c.FlapWindow = 60
+	}
+	if c.FlapHold <= 0 {
+		c.FlapHold = 300
+	}
+	if c.SnapshotInterval <= 0 {
+		c.SnapshotInterval = 60
+	}
+	if c.IngestSegmentBytes <= 0 {
+		c.IngestSegmentBytes = 16 << 20
+	}
+	if c.SyncTimeout <= 0 {
+		c.SyncTimeout = 10000
+	}
+	if c.BatchMaxBytes <= 0 {
+		c.BatchMaxBytes = 32 << 20
+	}
+	if c.Tracer == "" {
+		c.Tracer = TracerJaeger
+	}
+	if c.TraceSampleRatio == unset {
+		c.TraceSampleRatio = 1
+	}
+	if c.PartitionFailureThreshold <= 0 {
+		c.PartitionFailureThreshold = 5
+	}
+	if c.PartitionRecovery <= 0 {
+		c.PartitionRecovery = 30
+	}
+	if c.ProduceRetries < 0 {
+		c.ProduceRetries = 3
+	}
+	if c.ProduceRetryBackoff <= 0 {
+		c.ProduceRetryBackoff = 500
+	}
+	if c.MigrationStrategy == "" {
+		c.MigrationStrategy = MigrationReorder
+	}
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = 10000
+	}
+	if c.Transport == "" {
+		c.Transport = TransportKafka
+	}
+	if c.MemoryRetention <= 0 {
+		c.MemoryRetention = 100000
+	}
+	c.Kafka.setDefaults()
+}
+
+// Span exporters.
+const (
+	TracerOTLPGRPC = "otlp-grpc"
+	TracerOTLPHTTP = "otlp-http"
+	TracerJaeger   = "jaeger"
+	TracerStdout   = "stdout"
+	TracerNone     = "none"
+)
+
+// Migration strategies.
+const (
+	MigrationReorder = "reorder"
+	MigrationDrain   = "drain"
+)
+
+// Rebalance modes.
+const (
+	RebalanceAuto   = "auto"
+	RebalanceManual = "manual"
+)
+
+// MigrationPolicy returns the limits on moving flows.
+func (c *Config) MigrationPolicy() MigrationPolicy {
+	return MigrationPolicy{
+		Cooldown:      seconds(c.MigrationCooldown),
+		FlapThreshold: c.FlapThreshold,
+		FlapWindow:    seconds(c.FlapWindow),
+		FlapHold:      seconds(c.FlapHold),
+	}
+}
+
+// HealthPolicy returns when partitions are taken out of rotation.
+func (c *Config) HealthPolicy() HealthPolicy {
+	return HealthPolicy{
+		FailureThreshold: c.PartitionFailureThreshold,
+		Recovery:         seconds(c.PartitionRecovery),
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// RebalanceEvery returns the time between two rebalancing rounds.
+// The state-tracking strategies rebalance almost continuously, sleeping just enough
+// to avoid a busy loop, the others every `swap_interval` seconds.
+func (c *Config) RebalanceEvery() time.Duration {
+	switch c.Rebalancer {
+	case StateTrackingRebalancer, StateTrackingTolRebalancer:
+		return time.Duration(c.RebalanceSleep) * time.Millisecond
+	default:
+		return time.Duration(c.SwapInterval) * time.Second
+	}
 }
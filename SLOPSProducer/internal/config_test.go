@@ -0,0 +1,71 @@
+package internal
+
+import "testing"
+
+func TestConfigDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		cooldown float64
+		flaps    int
+		retries  int
+		produce  int // produce_retries
+	}{
+		{"left out", "partitions: 4\n", 10, 3, 5, 3},
+		{"disabled", "migration_cooldown: 0\nflap_threshold: 0\nproduce_retries: 0\nkafka:\n  retries: 0\n", 0, 0, 0, 0},
+		{"set", "migration_cooldown: 2.5\nflap_threshold: 5\nproduce_retries: 1\nkafka:\n  retries: 2\n", 2.5, 5, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf Config
+			if err := conf.Parse([]byte(tt.yaml)); err != nil {
+				t.Fatal(err)
+			}
+			if conf.MigrationCooldown != tt.cooldown {
+				t.Errorf("migration_cooldown %v, want %v", conf.MigrationCooldown, tt.cooldown)
+			}
+			if conf.FlapThreshold != tt.flaps {
+				t.Errorf("flap_threshold %v, want %v", conf.FlapThreshold, tt.flaps)
+			}
+			if conf.Kafka.Retries != tt.retries {
+				t.Errorf("kafka retries %v, want %v", conf.Kafka.Retries, tt.retries)
+			}
+			if conf.ProduceRetries != tt.produce {
+				t.Errorf("produce_retries %v, want %v", conf.ProduceRetries, tt.produce)
+			}
+		})
+	}
+}
+
+func TestConfigTraceSampleRatio(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		ratio float64
+		err   bool
+	}{
+		{name: "left out", yaml: "partitions: 4\n", ratio: 1},
+		{name: "off", yaml: "trace_sample_ratio: 0\n", ratio: 0},
+		{name: "fraction", yaml: "trace_sample_ratio: 0.25\n", ratio: 0.25},
+		{name: "above 1", yaml: "trace_sample_ratio: 1.5\n", err: true},
+		{name: "negative", yaml: "trace_sample_ratio: -0.5\n", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf Config
+			err := conf.Parse([]byte(tt.yaml))
+			if tt.err {
+				if err == nil {
+					t.Errorf("trace_sample_ratio %v accepted", conf.TraceSampleRatio)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.TraceSampleRatio != tt.ratio {
+				t.Errorf("trace_sample_ratio %v, want %v", conf.TraceSampleRatio, tt.ratio)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sync"
+)
+
+// CountMinHeap estimates counts with a Count-Min Sketch and keeps the
+// keys with the largest estimates in a fixed size heap.
+// The sketch is halved every bucket, so the estimates follow the current rate of the keys.
+type CountMinHeap struct {
+	mu       sync.Mutex
+	width    int        // Counters per row.
+	counts   [][]uint64 // One row of counters per hash function.
+	capacity int        // Number of keys kept in the heap.
+	top      *minHeap   // Keys with the largest estimates, smallest on top.
+	total    uint64     // Observations, halved every bucket like the sketch.
+}
+
+// NewCountMinHeap returns a sketch of depth rows of width counters that tracks the top `capacity` keys.
+func NewCountMinHeap(width, depth, capacity int) *CountMinHeap {
+	if width < 1 {
+		width = 1
+	}
+	if depth < 1 {
+		depth = 4
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	counts := make([][]uint64, depth)
+	for i := range counts {
+		counts[i] = make([]uint64, width)
+	}
+	return &CountMinHeap{
+		width:    width,
+		counts:   counts,
+		capacity: capacity,
+		top:      newMinHeap(capacity),
+	}
+}
+
+// Observe records one occurrence of key.
+func (cm *CountMinHeap) Observe(key string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	cm.total++
+	est := ^uint64(0)
+	h1, h2 := cm.hashes(key)
+	for i, row := range cm.counts {
+		c := &row[cm.column(h1, h2, i)]
+		*c++
+		if *c < est {
+			est = *c
+		}
+	}
+
+	if rec := cm.top.get(key); rec != nil {
+		rec.Count = est
+		cm.top.fix(key)
+		return
+	}
+	if cm.top.Len() < cm.capacity {
+		heap.Push(cm.top, &Record{Key: key, Count: est})
+		return
+	}
+	if est > cm.top.records[0].Count {
+		cm.top.replaceMin(&Record{Key: key, Count: est})
+	}
+}
+
+// Estimate returns the sketch estimate for key.
+func (cm *CountMinHeap) Estimate(key string) uint64 {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.estimate(key)
+}
+
+// TopK returns up to k keys of the heap by descending estimate.
+func (cm *CountMinHeap) TopK(k int) []Record {
+	cm.mu.Lock()
+	records := cm.top.snapshot()
+	cm.mu.Unlock()
+
+	return sortRecords(records, k)
+}
+
+// EndBucket halves every counter of the sketch and the estimates in the heap.
+// The estimate of a key is the smallest of its counters, so it is halved like them.
+func (cm *CountMinHeap) EndBucket() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	for _, row := range cm.counts {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	for _, rec := range cm.top.records {
+		rec.Count /= 2
+	}
+	cm.total /= 2
+}
+
+// Total returns the decayed number of observations.
+func (cm *CountMinHeap) Total() uint64 {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.total
+}
+
+// Len returns the number of keys in the heap.
+func (cm *CountMinHeap) Len() int {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	return cm.top.Len()
+}
+
+func (cm *CountMinHeap) estimate(key string) uint64 {
+	est := ^uint64(0)
+	h1, h2 := cm.hashes(key)
+	for i, row := range cm.counts {
+		if c := row[cm.column(h1, h2, i)]; c < est {
+			est = c
+		}
+	}
+	return est
+}
+
+// hashes returns the two halves of the 64 bit FNV-1a hash of key.
+// Row i uses h1 + i*h2 (Kirsch and Mitzenmacher).
+func (cm *CountMinHeap) hashes(key string) (uint32, uint32) {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	sum := hasher.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (cm *CountMinHeap) column(h1, h2 uint32, row int) int {
+	return int((h1 + uint32(row)*h2) % uint32(cm.width))
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeadLetterReplayGroup is the consumer group whose committed offset marks
+// how far the dead letter topic was replayed.
+const DeadLetterReplayGroup = "slops-dead-letter-replay"
+
+// DeadLetter is a message Kafka failed to write after every retry.
+type DeadLetter struct {
+	Key       string            `json:"key"`
+	Body      string            `json:"body"`
+	Headers   map[string]string `json:"headers,omitempty"` // Headers set by the client.
+	Partition int32             `json:"partition"`         // Partition the message was written to.
+	Msgset    *MessageSet       `json:"msgset,omitempty"`  // Message set header of the last attempt, nil without SMALOPS.
+	Error     string            `json:"error"`             // Why the last attempt failed.
+	Retries   int               `json:"retries"`           // Times the message was routed again.
+	FailedAt  time.Time         `json:"failed_at"`
+}
+
+// DeadLetterFile keeps dead letters on local disk when the dead letter topic cannot be written,
+// one JSON record per line.
+type DeadLetterFile struct {
+	path string
+
+	mu sync.Mutex
+}
+
+// NewDeadLetterFile returns the dead letter file at path. The file is created by the first dead letter.
+func NewDeadLetterFile(path string) *DeadLetterFile {
+	return &DeadLetterFile{path: path}
+}
+
+// Append adds a dead letter and syncs it to disk.
+func (df *DeadLetterFile) Append(dl DeadLetter) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	f, err := os.OpenFile(df.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Drain returns the dead letters in the order they were written and removes them from the file.
+// Lines that do not parse, torn by a crash, are skipped.
+func (df *DeadLetterFile) Drain() ([]DeadLetter, error) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+
+	f, err := os.Open(df.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	letters := make([]DeadLetter, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	for scanner.Scan() {
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			continue
+		}
+		letters = append(letters, dl)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", df.path, err)
+	}
+	if err := os.Remove(df.path); err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
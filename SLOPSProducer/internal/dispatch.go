@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Dispatcher shards keys onto a fixed set of ordered worker queues.
+// All tasks dispatched for a key land on the same queue and are run one
+// after the other by a single worker, so per-key arrival order is preserved
+// from the moment a task is dispatched until it returns.
+type Dispatcher struct {
+	queues []chan func() // One FIFO queue per worker.
+	wg     sync.WaitGroup
+}
+
+// NewDispatcher returns a dispatcher with `workers` queues, each buffering up to `queueSize` tasks.
+func NewDispatcher(workers, queueSize int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	d := &Dispatcher{
+		queues: make([]chan func(), workers),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan func(), queueSize)
+	}
+	return d
+}
+
+// Start launches one worker goroutine per queue.
+func (d *Dispatcher) Start() {
+	for _, q := range d.queues {
+		d.wg.Add(1)
+		go func(q chan func()) {
+			defer d.wg.Done()
+			for task := range q {
+				task()
+			}
+		}(q)
+	}
+}
+
+// Dispatch queues a task behind every task previously dispatched for the same key.
+// It blocks while the key's queue is full.
+func (d *Dispatcher) Dispatch(key string, task func()) {
+	d.queues[d.shard(key)] <- task
+}
+
+// Close stops accepting tasks and waits for the queued ones to finish.
+func (d *Dispatcher) Close() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+// Workers returns the number of ordered queues.
+func (d *Dispatcher) Workers() int {
+	return len(d.queues)
+}
+
+// shard maps a key to its queue.
+func (d *Dispatcher) shard(key string) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	return int(hasher.Sum32() % uint32(len(d.queues)))
+}
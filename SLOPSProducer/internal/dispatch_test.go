@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keysOnShards returns a key on each of two different queues of d.
+func keysOnShards(t *testing.T, d *Dispatcher) (string, string) {
+	t.Helper()
+	first := "key-0"
+	for i := 1; i < 100; i++ {
+		if key := fmt.Sprintf("key-%d", i); d.shard(key) != d.shard(first) {
+			return first, key
+		}
+	}
+	t.Fatal("every key is on the same queue")
+	return "", ""
+}
+
+func TestDispatcherKeyOrder(t *testing.T) {
+	d := NewDispatcher(4, 8)
+	d.Start()
+
+	var mu sync.Mutex
+	got := map[string][]int{}
+	keys := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 200; i++ {
+		key, n := keys[i%len(keys)], i
+		d.Dispatch(key, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			got[key] = append(got[key], n)
+		})
+	}
+	d.Close()
+
+	for _, key := range keys {
+		if len(got[key]) != 200/len(keys) {
+			t.Fatalf("key %s ran %d tasks, want %d", key, len(got[key]), 200/len(keys))
+		}
+		for i := 1; i < len(got[key]); i++ {
+			if got[key][i] < got[key][i-1] {
+				t.Fatalf("key %s ran task %d after task %d", key, got[key][i], got[key][i-1])
+			}
+		}
+	}
+}
+
+func TestDispatcherShardsIndependent(t *testing.T) {
+	d := NewDispatcher(2, 1)
+	d.Start()
+	defer d.Close()
+	blocked, free := keysOnShards(t, d)
+
+	// The queue of the first key is stuck on a task.
+	unblock := make(chan struct{})
+	defer close(unblock)
+	d.Dispatch(blocked, func() { <-unblock })
+
+	ran := make(chan struct{})
+	d.Dispatch(free, func() { close(ran) })
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a key waited for a key on another queue")
+	}
+}
+
+func TestDispatcherBackPressure(t *testing.T) {
+	d := NewDispatcher(1, 2)
+	d.Start()
+	defer d.Close()
+
+	// The worker is stuck on the first task and the queue holds the next two.
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	d.Dispatch("a", func() {
+		close(started)
+		<-unblock
+	})
+	<-started
+	d.Dispatch("a", func() {})
+	d.Dispatch("a", func() {})
+
+	dispatched := make(chan struct{})
+	go func() {
+		d.Dispatch("a", func() {})
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+		t.Fatal("dispatch to a full queue did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(unblock)
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatch stayed blocked once the queue drained")
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import "sync"
+
+// ExactCounter counts every key explicitly over a sliding window of buckets.
+// It is expensive, but gives the ground truth the approximate backends are measured against.
+type ExactCounter struct {
+	mu      sync.Mutex
+	window  int                 // Number of buckets counted.
+	current map[string]uint64   // Counts of the open bucket.
+	buckets []map[string]uint64 // Counts of the closed buckets in the window, oldest first.
+	totals  map[string]uint64   // Counts over the window, including the open bucket.
+	total   uint64              // Observations over the window.
+}
+
+// NewExactCounter returns a counter over the last `window` buckets.
+func NewExactCounter(window int) *ExactCounter {
+	if window < 1 {
+		window = 1
+	}
+	return &ExactCounter{
+		window:  window,
+		current: map[string]uint64{},
+		totals:  map[string]uint64{},
+	}
+}
+
+// Observe records one occurrence of key.
+func (ec *ExactCounter) Observe(key string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ec.current[key]++
+	ec.totals[key]++
+	ec.total++
+}
+
+// Estimate returns the count of key over the window.
+func (ec *ExactCounter) Estimate(key string) uint64 {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	return ec.totals[key]
+}
+
+// TopK returns up to k keys by descending count over the window.
+func (ec *ExactCounter) TopK(k int) []Record {
+	ec.mu.Lock()
+	records := make([]Record, 0, len(ec.totals))
+	for key, count := range ec.totals {
+		records = append(records, Record{Key: key, Count: count})
+	}
+	ec.mu.Unlock()
+
+	return sortRecords(records, k)
+}
+
+// EndBucket closes the open bucket and slides the oldest one out of the window.
+func (ec *ExactCounter) EndBucket() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	ec.buckets = append(ec.buckets, ec.current)
+	ec.current = map[string]uint64{}
+	if len(ec.buckets) < ec.window {
+		return
+	}
+	oldest := ec.buckets[0]
+	ec.buckets = ec.buckets[1:]
+	for key, count := range oldest {
+		ec.total -= count
+		if ec.totals[key] <= count {
+			delete(ec.totals, key)
+		} else {
+			ec.totals[key] -= count
+		}
+	}
+}
+
+// Total returns the number of observations over the window.
+func (ec *ExactCounter) Total() uint64 {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	return ec.total
+}
+
+// Len returns the number of keys seen in the window.
+func (ec *ExactCounter) Len() int {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	return len(ec.totals)
+}
@@ -0,0 +1,37 @@
+package internal
+
+import "testing"
+
+func TestExactCounterWindow(t *testing.T) {
+	ec := NewExactCounter(2)
+	buckets := [][]string{
+		{"a", "a", "b"},
+		{"a", "c"},
+		{"c", "c", "c", "d"},
+	}
+	tests := []struct {
+		total  uint64
+		counts map[string]uint64
+	}{
+		{total: 3, counts: map[string]uint64{"a": 2, "b": 1}},
+		{total: 5, counts: map[string]uint64{"a": 3, "b": 1, "c": 1}},
+		{total: 6, counts: map[string]uint64{"a": 1, "c": 4, "d": 1}},
+	}
+	for i, bucket := range buckets {
+		for _, key := range bucket {
+			ec.Observe(key)
+		}
+		if got := ec.Total(); got != tests[i].total {
+			t.Errorf("bucket %d: total %d, want %d", i, got, tests[i].total)
+		}
+		if got := ec.Len(); got != len(tests[i].counts) {
+			t.Errorf("bucket %d: %d keys, want %d", i, got, len(tests[i].counts))
+		}
+		for key, want := range tests[i].counts {
+			if got := ec.Estimate(key); got != want {
+				t.Errorf("bucket %d: count of %s %d, want %d", i, key, got, want)
+			}
+		}
+		ec.EndBucket()
+	}
+}
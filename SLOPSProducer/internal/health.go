@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"sort"
+	"time"
+)
+
+// HealthPolicy decides when a partition is taken out of rotation because Kafka keeps failing to write to it.
+type HealthPolicy struct {
+	FailureThreshold int           // Consecutive produce errors that mark a partition unhealthy.
+	Recovery         time.Duration // An unhealthy partition is tried again this long after its last error.
+}
+
+// partitionHealth counts the produce errors of a partition.
+type partitionHealth struct {
+	failures    int // Consecutive produce errors.
+	unhealthy   bool
+	lastFailure time.Time
+}
+
+// PartitionHealth is the health of a partition that had produce errors.
+type PartitionHealth struct {
+	Partition   int       `json:"partition"`
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"` // Consecutive produce errors.
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// SetHealthPolicy sets when partitions are taken out of rotation.
+func (pm *PartitionMap) SetHealthPolicy(policy HealthPolicy) {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	pm.healthPolicy = policy
+}
+
+// healthy reports whether a partition takes traffic. Callers hold healthMu.
+// An unhealthy partition is tried again once `Recovery` passed since its last error:
+// the next acknowledgement brings it back, the next error takes it out again.
+func (pm *PartitionMap) healthy(partition int, now time.Time) bool {
+	h, ok := pm.health[partition]
+	if !ok || !h.unhealthy {
+		return true
+	}
+	return pm.healthPolicy.Recovery > 0 && now.Sub(h.lastFailure) >= pm.healthPolicy.Recovery
+}
+
+// Healthy reports whether a partition takes traffic.
+func (pm *PartitionMap) Healthy(partition int) bool {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	return pm.healthy(partition, time.Now())
+}
+
+// HealthyPartitions returns the partitions below `partitions` that take traffic.
+func (pm *PartitionMap) HealthyPartitions(partitions int) []int {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	now := time.Now()
+	healthy := make([]int, 0, partitions)
+	for p := 0; p < partitions; p++ {
+		if pm.healthy(p, now) {
+			healthy = append(healthy, p)
+		}
+	}
+	return healthy
+}
+
+// ProduceFailed records that Kafka failed to write a message to a partition.
+// Returns true if the partition just stopped taking traffic, so its flows should be moved.
+func (pm *PartitionMap) ProduceFailed(partition int) bool {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	now := time.Now()
+	was := pm.healthy(partition, now)
+	h, ok := pm.health[partition]
+	if !ok {
+		h = &partitionHealth{}
+		pm.health[partition] = h
+	}
+	h.failures++
+	h.lastFailure = now
+	if pm.healthPolicy.FailureThreshold > 0 && h.failures >= pm.healthPolicy.FailureThreshold {
+		h.unhealthy = true
+	}
+	return was && !pm.healthy(partition, now)
+}
+
+// ProduceSucceeded records that Kafka acknowledged a message written to a partition.
+// Returns true if the partition was unhealthy and takes traffic again.
+func (pm *PartitionMap) ProduceSucceeded(partition int) bool {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	h, ok := pm.health[partition]
+	if !ok {
+		return false
+	}
+	delete(pm.health, partition)
+	return h.unhealthy
+}
+
+// Health returns the partitions that failed their last produce, by partition.
+func (pm *PartitionMap) Health() []PartitionHealth {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	now := time.Now()
+	health := make([]PartitionHealth, 0, len(pm.health))
+	for p, h := range pm.health {
+		health = append(health, PartitionHealth{
+			Partition:   p,
+			Healthy:     pm.healthy(p, now),
+			Failures:    h.failures,
+			LastFailure: h.lastFailure,
+		})
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Partition < health[j].Partition })
+	return health
+}
+
+// dropUnhealthy removes the partitions that take no traffic from a snapshot of the store,
+// so a rebalancer neither moves flows to them nor counts them.
+func (pm *PartitionMap) dropUnhealthy(store map[int][]KeyRecord) {
+	pm.healthMu.Lock()
+	defer pm.healthMu.Unlock()
+
+	now := time.Now()
+	for p := range store {
+		if !pm.healthy(p, now) {
+			delete(store, p)
+		}
+	}
+}
+
+// Movable returns the keys on a partition that were not pinned by an operator.
+func (pm *PartitionMap) Movable(partition int) []string {
+	pm.storeMu.RLock()
+	defer pm.storeMu.RUnlock()
+
+	keys := make([]string, 0, len(pm.store[partition]))
+	for _, kc := range pm.store[partition] {
+		if !kc.Pinned {
+			keys = append(keys, kc.Key)
+		}
+	}
+	return keys
+}
+
+// Evacuate moves a key off an unhealthy partition regardless of the migration policy.
+// Like a manual move it starts a cooldown but does not count towards flapping.
+// Returns false if the key is no longer on the source partition or was pinned since.
+func (pm *PartitionMap) Evacuate(key string, srcPartition, dstPartition int) (Move, bool) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	kc := pm.getKey(key)
+	if kc == nil || kc.Pinned || kc.Partition != srcPartition || srcPartition == dstPartition {
+		return Move{}, false
+	}
+	m := Move{Key: key, Weight: kc.Weight, Src: srcPartition, Dst: dstPartition}
+	pm.recordManualMove(pm.relocate(kc, dstPartition))
+	pm.logRecord(key)
+	return m, true
+}
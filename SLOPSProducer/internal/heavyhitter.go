@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Record is a tracked key and its estimated count.
+type Record struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"` // Estimated number of occurrences.
+	Error uint64 `json:"error"` // Maximum error of Count.
+}
+
+// HeavyHitter detects the most frequent keys of a stream.
+// Implementations are safe for concurrent use.
+type HeavyHitter interface {
+	// Observe records one occurrence of key.
+	Observe(key string)
+	// Estimate returns the estimated count of key.
+	Estimate(key string) uint64
+	// TopK returns up to k tracked keys by descending count.
+	// All tracked keys are returned if k <= 0.
+	TopK(k int) []Record
+	// EndBucket is called every 1/epsilon observations.
+	EndBucket()
+	// Total returns the number of observations the counts are relative to.
+	Total() uint64
+	// Len returns the number of tracked keys.
+	Len() int
+}
+
+// Thresholds returns the count from which a key is hot, (support-epsilon)*N, and the
+// count up to which a key cannot be frequent and is not hot anymore, epsilon*N.
+// N is the number of observations the counts of the backend are relative to.
+func Thresholds(hh HeavyHitter, support, epsilon float64) (hot, cold float64) {
+	total := float64(hh.Total())
+	return (support - epsilon) * total, epsilon * total
+}
+
+// Names of the heavy hitter backends.
+const (
+	LossyCounting = "lossy"
+	SpaceSaving   = "space-saving"
+	CountMin      = "count-min"
+	Exact         = "exact"
+)
+
+// NewHeavyHitter returns the backend selected in the configuration.
+func NewHeavyHitter(conf *Config) (HeavyHitter, error) {
+	capacity := conf.HeavyHitterCapacity
+	if capacity <= 0 {
+		// Space-Saving with 1/epsilon counters guarantees an error of at most epsilon*N.
+		capacity = int(math.Ceil(1 / conf.Epsilon))
+	}
+	switch conf.HeavyHitter {
+	case "", LossyCounting:
+		return NewLossyCounter(), nil
+	case SpaceSaving:
+		return NewSpaceSaving(capacity), nil
+	case CountMin:
+		width := conf.CMSWidth
+		if width <= 0 {
+			width = int(math.Ceil(math.E / conf.Epsilon))
+		}
+		return NewCountMinHeap(width, conf.CMSDepth, capacity), nil
+	case Exact:
+		return NewExactCounter(conf.ExactWindow), nil
+	default:
+		return nil, fmt.Errorf("unknown heavy hitter backend %q", conf.HeavyHitter)
+	}
+}
+
+// sortRecords orders records by descending count and keeps the first k.
+func sortRecords(records []Record, k int) []Record {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Count == records[j].Count {
+			return records[i].Key < records[j].Key
+		}
+		return records[i].Count > records[j].Count
+	})
+	if k > 0 && len(records) > k {
+		records = records[:k]
+	}
+	return records
+}
+
+// minHeap is a heap of records with the smallest count on top.
+// It is shared by the backends that keep a fixed number of candidates.
+type minHeap struct {
+	records []*Record
+	index   map[string]int // Position of each key in records.
+}
+
+func newMinHeap(capacity int) *minHeap {
+	return &minHeap{
+		records: make([]*Record, 0, capacity),
+		index:   make(map[string]int, capacity),
+	}
+}
+
+func (h *minHeap) Len() int           { return len(h.records) }
+func (h *minHeap) Less(i, j int) bool { return h.records[i].Count < h.records[j].Count }
+func (h *minHeap) Swap(i, j int) {
+	h.records[i], h.records[j] = h.records[j], h.records[i]
+	h.index[h.records[i].Key] = i
+	h.index[h.records[j].Key] = j
+}
+
+func (h *minHeap) Push(x any) {
+	rec := x.(*Record)
+	h.index[rec.Key] = len(h.records)
+	h.records = append(h.records, rec)
+}
+
+func (h *minHeap) Pop() any {
+	n := len(h.records)
+	rec := h.records[n-1]
+	h.records = h.records[:n-1]
+	delete(h.index, rec.Key)
+	return rec
+}
+
+// get returns the record of a key, or nil if the key is not in the heap.
+func (h *minHeap) get(key string) *Record {
+	if i, ok := h.index[key]; ok {
+		return h.records[i]
+	}
+	return nil
+}
+
+// fix restores the heap after the count of key changed.
+func (h *minHeap) fix(key string) {
+	heap.Fix(h, h.index[key])
+}
+
+// replaceMin swaps the smallest record for rec.
+func (h *minHeap) replaceMin(rec *Record) {
+	delete(h.index, h.records[0].Key)
+	h.records[0] = rec
+	h.index[rec.Key] = 0
+	heap.Fix(h, 0)
+}
+
+// snapshot returns a copy of every record.
+func (h *minHeap) snapshot() []Record {
+	records := make([]Record, len(h.records))
+	for i, rec := range h.records {
+		records[i] = *rec
+	}
+	return records
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"testing"
+)
+
+const (
+	testSupport = 0.1
+	testEpsilon = 0.01
+)
+
+// phase is a run of buckets of 1/epsilon keys. In every bucket the hot keys take
+// their share of the keys, the rest are keys seen once.
+type phase struct {
+	buckets int
+	shares  map[string]int // Keys per bucket of each hot key.
+}
+
+// feed observes the phases bucket by bucket and returns the hot keys at the end.
+func feed(hh HeavyHitter, phases []phase) []string {
+	width := int(math.Round(1 / testEpsilon))
+	bucket := 0
+	for _, ph := range phases {
+		for b := 0; b < ph.buckets; b++ {
+			keys := make([]string, 0, width)
+			for key, n := range ph.shares {
+				for i := 0; i < n; i++ {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for i := len(keys); i < width; i++ {
+				keys = append(keys, fmt.Sprintf("once-%d-%d", bucket, i))
+			}
+			// Interleave the hot keys with the others.
+			for i := 0; i < width; i++ {
+				hh.Observe(keys[(i*37)%width])
+			}
+			hh.EndBucket()
+			bucket++
+		}
+	}
+
+	threshold, _ := Thresholds(hh, testSupport, testEpsilon)
+	hot := make([]string, 0)
+	for _, rec := range hh.TopK(0) {
+		if float64(rec.Count) >= threshold {
+			hot = append(hot, rec.Key)
+		}
+	}
+	sort.Strings(hot)
+	return hot
+}
+
+func TestHeavyHitterHotKeys(t *testing.T) {
+	steady := []phase{{buckets: 10, shares: map[string]int{"a": 30, "b": 15, "c": 5}}}
+	// "a" stops after 5 buckets and "c" takes over.
+	shift := []phase{
+		{buckets: 5, shares: map[string]int{"a": 30, "b": 15}},
+		{buckets: 10, shares: map[string]int{"b": 15, "c": 30}},
+	}
+	capacity := int(math.Ceil(1 / testEpsilon))
+	width := int(math.Ceil(math.E / testEpsilon))
+	backends := map[string]func() HeavyHitter{
+		LossyCounting: func() HeavyHitter { return NewLossyCounter() },
+		SpaceSaving:   func() HeavyHitter { return NewSpaceSaving(capacity) },
+		CountMin:      func() HeavyHitter { return NewCountMinHeap(width, 4, capacity) },
+	}
+	tests := []struct {
+		backend string
+		name    string
+		phases  []phase
+		want    []string
+	}{
+		{LossyCounting, "steady", steady, []string{"a", "b"}},
+		{SpaceSaving, "steady", steady, []string{"a", "b"}},
+		{CountMin, "steady", steady, []string{"a", "b"}},
+		// Lossy counting counts the whole stream: "a" still has 10% of it.
+		{LossyCounting, "shift", shift, []string{"a", "b", "c"}},
+		// The decayed backends follow the current rate.
+		{SpaceSaving, "shift", shift, []string{"b", "c"}},
+		{CountMin, "shift", shift, []string{"b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend+"/"+tt.name, func(t *testing.T) {
+			got := feed(backends[tt.backend](), tt.phases)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("hot keys %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeavyHitterThresholds(t *testing.T) {
+	tests := []struct {
+		name      string
+		hh        HeavyHitter
+		observed  int
+		buckets   int
+		wantTotal uint64
+	}{
+		{"lossy counts every observation", NewLossyCounter(), 100, 3, 300},
+		{"space-saving halves every bucket", NewSpaceSaving(10), 100, 3, 50 + 25 + 100/8},
+		{"count-min halves every bucket", NewCountMinHeap(100, 4, 10), 100, 3, 50 + 25 + 100/8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for b := 0; b < tt.buckets; b++ {
+				for i := 0; i < tt.observed; i++ {
+					tt.hh.Observe(fmt.Sprint(i % 7))
+				}
+				tt.hh.EndBucket()
+			}
+			if got := tt.hh.Total(); got != tt.wantTotal {
+				t.Fatalf("total %d, want %d", got, tt.wantTotal)
+			}
+			hot, cold := Thresholds(tt.hh, testSupport, testEpsilon)
+			if want := (testSupport - testEpsilon) * float64(tt.wantTotal); math.Abs(hot-want) > 1e-9 {
+				t.Errorf("hot threshold %v, want %v", hot, want)
+			}
+			if want := testEpsilon * float64(tt.wantTotal); math.Abs(cold-want) > 1e-9 {
+				t.Errorf("cold threshold %v, want %v", cold, want)
+			}
+		})
+	}
+}
+
+func TestLossyCounterPrunes(t *testing.T) {
+	lc := NewLossyCounter()
+	// Bucket 1: "a" twice, "b" once. "b" is pruned at the end of bucket 1.
+	for _, key := range []string{"a", "a", "b"} {
+		lc.Observe(key)
+	}
+	lc.EndBucket()
+	if lc.Estimate("b") != 0 || lc.Estimate("a") != 2 {
+		t.Fatalf("after bucket 1: a=%d b=%d, want a=2 b=0", lc.Estimate("a"), lc.Estimate("b"))
+	}
+	// Bucket 2: "a" is not seen again, its count plus error no longer exceeds the bucket.
+	lc.Observe("c")
+	lc.EndBucket()
+	if lc.Len() != 0 {
+		t.Fatalf("after bucket 2: %v tracked, want none", lc.TopK(0))
+	}
+}
+
+func TestSpaceSavingError(t *testing.T) {
+	ss := NewSpaceSaving(2)
+	for _, key := range []string{"a", "a", "a", "b", "c"} {
+		ss.Observe(key)
+	}
+	// "c" took over the counter of "b" and inherited its count as the error.
+	records := ss.TopK(0)
+	want := []Record{{Key: "a", Count: 3}, {Key: "c", Count: 2, Error: 1}}
+	if fmt.Sprint(records) != fmt.Sprint(want) {
+		t.Fatalf("records %v, want %v", records, want)
+	}
+}
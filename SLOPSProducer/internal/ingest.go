@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// IngestRecord is a message accepted over HTTP.
+type IngestRecord struct {
+	Seq     uint64            `json:"seq"`
+	Key     string            `json:"key"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// IngestLog is an append-only log of the accepted messages, kept until Kafka acknowledges them.
+// Records go to segment files named after their first sequence number. The acknowledgement
+// watermark, below which every record was acknowledged, is checkpointed to a file and
+// segments entirely below it are deleted. Records Kafka failed to write are moved to a
+// separate file so they do not hold the watermark back.
+// On startup the records above the watermark are returned for replay.
+type IngestLog struct {
+	dir          string
+	segmentBytes int64 // Size at which a new segment is started.
+	sync         bool  // Sync every record to disk before it is acknowledged to the client.
+
+	mu         sync.Mutex
+	next       uint64 // Sequence number of the next record.
+	segments   []*segment
+	active     *os.File // Last segment, open for appending.
+	activeSize int64
+	watermark  uint64              // Every record up to the watermark was acknowledged.
+	acked      map[uint64]struct{} // Acknowledged records above the watermark.
+	saved      uint64              // Watermark of the last checkpoint.
+}
+
+type segment struct {
+	path  string
+	first uint64
+	last  uint64 // Sequence number of the last record, first-1 if the segment is empty.
+}
+
+const (
+	segmentPrefix = "ingest-"
+	segmentSuffix = ".log"
+	ackFile       = "ack"
+	failedFile    = "failed.log"
+)
+
+// OpenIngestLog opens the log in dir and returns the records that were not acknowledged, in order.
+// Records acknowledged after the last checkpoint are returned too, so replay is at least once.
+func OpenIngestLog(dir string, segmentBytes int64, sync bool) (*IngestLog, []IngestRecord, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	il := &IngestLog{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		sync:         sync,
+		acked:        map[uint64]struct{}{},
+	}
+
+	watermark, err := il.readWatermark()
+	if err != nil {
+		return nil, nil, err
+	}
+	il.watermark, il.saved = watermark, watermark
+	maxSeq := watermark
+
+	// Records in the segments.
+	paths, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentSuffix))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+	pending := map[uint64]IngestRecord{}
+	for _, path := range paths {
+		seg := &segment{path: path}
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), segmentPrefix), segmentSuffix)
+		if seg.first, err = strconv.ParseUint(name, 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("%s: not a segment", path)
+		}
+		seg.last = seg.first - 1
+		records, err := readRecords(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rec := range records {
+			seg.last = rec.Seq
+			if rec.Seq > maxSeq {
+				maxSeq = rec.Seq
+			}
+			if rec.Seq > watermark {
+				pending[rec.Seq] = rec
+			}
+		}
+		il.segments = append(il.segments, seg)
+	}
+
+	// Records Kafka failed to write. They are logged again below with new sequence numbers.
+	failed, err := readRecords(filepath.Join(dir, failedFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	for _, rec := range failed {
+		delete(pending, rec.Seq)
+		if rec.Seq > maxSeq {
+			maxSeq = rec.Seq
+		}
+	}
+
+	// Everything above the watermark that is not replayed from the segments is done with.
+	for seq := watermark + 1; seq <= maxSeq; seq++ {
+		if _, ok := pending[seq]; !ok {
+			il.Ack(seq)
+		}
+	}
+	il.next = maxSeq + 1
+	if err := il.roll(); err != nil {
+		return nil, nil, err
+	}
+
+	replay := append(failed, make([]IngestRecord, 0, len(pending))...)
+	for _, rec := range pending {
+		replay = append(replay, rec)
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i].Seq < replay[j].Seq })
+	if len(failed) == 0 {
+		return il, replay, nil
+	}
+
+	// The failed records need new sequence numbers. The pending records are logged again
+	// behind them too, so the log keeps the order of the replay after another crash,
+	// and the old records are acknowledged.
+	for i := range replay {
+		if replay[i].Seq, err = il.Append(replay[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := il.active.Sync(); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Remove(filepath.Join(dir, failedFile)); err != nil {
+		return nil, nil, err
+	}
+	for seq := range pending {
+		il.Ack(seq)
+	}
+	if err := il.Checkpoint(); err != nil {
+		return nil, nil, err
+	}
+	return il, replay, nil
+}
+
+func (il *IngestLog) readWatermark() (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(il.dir, ackFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readRecords reads a file of records. Lines that do not parse, torn by a crash, are skipped.
+func readRecords(path string) ([]IngestRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make([]IngestRecord, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	for scanner.Scan() {
+		var rec IngestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+// roll starts a new segment at the next sequence number. Callers hold the lock or own the log.
+func (il *IngestLog) roll() error {
+	if il.active != nil {
+		if err := il.active.Close(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(il.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, il.next, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	il.active = f
+	il.activeSize = 0
+	// An empty segment left by the previous run is reused.
+	if n := len(il.segments); n > 0 && il.segments[n-1].path == path {
+		return nil
+	}
+	il.segments = append(il.segments, &segment{path: path, first: il.next, last: il.next - 1})
+	return nil
+}
+
+// Append logs a message and returns the sequence number it was given.
+// The record is written to the file before Append returns, so it survives a crash of the process,
+// and synced to disk as well with `sync` set.
+func (il *IngestLog) Append(rec IngestRecord) (uint64, error) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	rec.Seq = il.next
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	n, err := il.active.Write(append(data, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	if il.sync {
+		if err := il.active.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	il.next++
+	il.activeSize += int64(n)
+	il.segments[len(il.segments)-1].last = rec.Seq
+	if il.activeSize >= il.segmentBytes {
+		if err := il.roll(); err != nil {
+			return 0, err
+		}
+	}
+	return rec.Seq, nil
+}
+
+// Ack records that Kafka acknowledged a message.
+func (il *IngestLog) Ack(seq uint64) {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	if seq <= il.watermark {
+		return
+	}
+	if seq != il.watermark+1 {
+		il.acked[seq] = struct{}{}
+		return
+	}
+	il.watermark++
+	for {
+		if _, ok := il.acked[il.watermark+1]; !ok {
+			return
+		}
+		delete(il.acked, il.watermark+1)
+		il.watermark++
+	}
+}
+
+// Fail moves a message Kafka failed to write out of the way of the watermark.
+// It is kept in a separate file and replayed on the next start.
+func (il *IngestLog) Fail(rec IngestRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(il.dir, failedFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	il.Ack(rec.Seq)
+	return nil
+}
+
+// Checkpoint saves the watermark and deletes the segments that were entirely acknowledged.
+func (il *IngestLog) Checkpoint() error {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	if il.watermark == il.saved {
+		return nil
+	}
+	path := filepath.Join(il.dir, ackFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(il.watermark, 10)), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	il.saved = il.watermark
+
+	// The active segment is never deleted.
+	for len(il.segments) > 1 && il.segments[0].last <= il.watermark {
+		if err := os.Remove(il.segments[0].path); err != nil {
+			return err
+		}
+		il.segments = il.segments[1:]
+	}
+	return nil
+}
+
+// Pending returns the number of messages waiting for an acknowledgement.
+func (il *IngestLog) Pending() int {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	return int(il.next-1-il.watermark) - len(il.acked)
+}
+
+// Close checkpoints and closes the log.
+func (il *IngestLog) Close() error {
+	if err := il.Checkpoint(); err != nil {
+		return err
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	return il.active.Close()
+}
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// appendKeys logs one record per key.
+func appendKeys(t *testing.T, il *IngestLog, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		if _, err := il.Append(IngestRecord{Key: key, Body: "body-" + key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// crash closes the log without a checkpoint, like a producer that was killed.
+func crash(t *testing.T, il *IngestLog) {
+	t.Helper()
+	if err := il.active.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func replayedKeys(records []IngestRecord) []string {
+	keys := make([]string, 0, len(records))
+	for _, rec := range records {
+		keys = append(keys, rec.Key)
+	}
+	return keys
+}
+
+func TestIngestLogWatermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		acks      []uint64
+		watermark uint64
+		pending   int
+	}{
+		{"in order", []uint64{1, 2, 3}, 3, 2},
+		{"gap", []uint64{2, 3}, 0, 3},
+		{"gap filled", []uint64{2, 3, 1}, 3, 2},
+		{"reversed", []uint64{5, 4, 3, 2, 1}, 5, 0},
+		{"duplicate", []uint64{1, 1, 2}, 2, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			il, replay, err := OpenIngestLog(t.TempDir(), 1<<20, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer il.Close()
+			if len(replay) != 0 {
+				t.Fatalf("new log replays %d records", len(replay))
+			}
+			appendKeys(t, il, "a", "b", "c", "d", "e")
+			for _, seq := range tt.acks {
+				il.Ack(seq)
+			}
+			if il.watermark != tt.watermark {
+				t.Errorf("watermark %d, want %d", il.watermark, tt.watermark)
+			}
+			if got := il.Pending(); got != tt.pending {
+				t.Errorf("%d pending, want %d", got, tt.pending)
+			}
+		})
+	}
+}
+
+func TestIngestLogReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		acks       []uint64
+		fail       []uint64 // Records moved to the failed file.
+		checkpoint bool
+		replay     []string
+	}{
+		{name: "nothing acknowledged", replay: []string{"a", "b", "c", "d", "e"}},
+		{name: "checkpointed", acks: []uint64{1, 2}, checkpoint: true, replay: []string{"c", "d", "e"}},
+		{name: "acknowledged after the checkpoint", acks: []uint64{1, 2}, replay: []string{"a", "b", "c", "d", "e"}},
+		{name: "above the watermark", acks: []uint64{1, 3}, checkpoint: true, replay: []string{"b", "c", "d", "e"}},
+		{name: "all acknowledged", acks: []uint64{1, 2, 3, 4, 5}, checkpoint: true, replay: []string{}},
+		{name: "failed", acks: []uint64{1, 3, 4, 5}, fail: []uint64{2}, checkpoint: true, replay: []string{"b"}},
+		{name: "failed before the checkpoint", fail: []uint64{2}, replay: []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			il, _, err := OpenIngestLog(dir, 1<<20, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendKeys(t, il, "a", "b", "c", "d", "e")
+			for _, seq := range tt.acks {
+				il.Ack(seq)
+			}
+			for _, seq := range tt.fail {
+				key := string(rune('a' + seq - 1))
+				if err := il.Fail(IngestRecord{Seq: seq, Key: key, Body: "body-" + key}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.checkpoint {
+				if err := il.Checkpoint(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			crash(t, il)
+
+			il, replay, err := OpenIngestLog(dir, 1<<20, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := replayedKeys(replay); !reflect.DeepEqual(got, tt.replay) {
+				t.Errorf("replayed %v, want %v", got, tt.replay)
+			}
+			for i := 1; i < len(replay); i++ {
+				if replay[i].Seq <= replay[i-1].Seq {
+					t.Errorf("replayed sequence numbers %d, %d out of order", replay[i-1].Seq, replay[i].Seq)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, failedFile)); !os.IsNotExist(err) {
+				t.Errorf("failed file left after the replay: %v", err)
+			}
+			if got := il.Pending(); got != len(tt.replay) {
+				t.Errorf("%d pending after the replay, want %d", got, len(tt.replay))
+			}
+
+			// The replayed records are logged again: a second crash replays them once more, not twice.
+			crash(t, il)
+			il, again, err := OpenIngestLog(dir, 1<<20, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer il.Close()
+			if got := replayedKeys(again); !reflect.DeepEqual(got, replayedKeys(replay)) {
+				t.Errorf("second replay %v, want %v", got, replayedKeys(replay))
+			}
+		})
+	}
+}
+
+func TestIngestLogTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	il, _, err := OpenIngestLog(dir, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendKeys(t, il, "a", "b")
+	if _, err := il.active.WriteString(`{"seq":3,"key":"c","bo`); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, il)
+
+	il, replay, err := OpenIngestLog(dir, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer il.Close()
+	if got := replayedKeys(replay); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("replayed %v, want [a b]", got)
+	}
+}
+
+func TestIngestLogCheckpointSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Every record fills a segment.
+	il, _, err := OpenIngestLog(dir, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer il.Close()
+	appendKeys(t, il, "a", "b", "c", "d")
+
+	segments := func() int {
+		paths, err := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentSuffix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(paths)
+	}
+	tests := []struct {
+		acks     []uint64
+		segments int
+	}{
+		{nil, 5},
+		{[]uint64{2}, 5},
+		{[]uint64{1}, 3},
+		{[]uint64{3, 4}, 1},
+	}
+	for i, tt := range tests {
+		for _, seq := range tt.acks {
+			il.Ack(seq)
+		}
+		if err := il.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		if got := segments(); got != tt.segments {
+			t.Errorf("step %d: %d segments, want %d", i, got, tt.segments)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// KafkaConfig holds the settings of the Kafka producer.
+type KafkaConfig struct {
+	Brokers         []string `yaml:"brokers"`           // Bootstrap brokers, KAFKA_BOOTSTRAP if unset.
+	Topic           string   `yaml:"topic"`             // Topic the messages are written to.
+	ClientID        string   `yaml:"client_id"`         // Client ID, ADDRESS if unset.
+	Version         string   `yaml:"version"`           // Kafka version the producer speaks, sarama's default if unset.
+	Acks            string   `yaml:"acks"`              // Acknowledgements a write waits for: none, leader or all.
+	Retries         int      `yaml:"retries"`           // Times a failed write is retried, 0 to never retry.
+	RetryBackoff    int      `yaml:"retry_backoff"`     // Milliseconds between retries.
+	Compression     string   `yaml:"compression"`       // none, gzip, snappy, lz4 or zstd.
+	FlushFrequency  int      `yaml:"flush_frequency"`   // Milliseconds between flushes of a batch.
+	FlushMessages   int      `yaml:"flush_messages"`    // Messages that trigger a flush, 0 for no limit.
+	FlushBytes      int      `yaml:"flush_bytes"`       // Bytes that trigger a flush, 0 for no limit.
+	MaxMessageBytes int      `yaml:"max_message_bytes"` // Largest message accepted.
+	Idempotent      bool     `yaml:"idempotent"`        // Write every message exactly once, needs acks: all and max_open_requests: 1.
+	MaxOpenRequests int      `yaml:"max_open_requests"` // Requests in flight per broker, more than 1 can reorder messages that are retried.
+
+	TLS  KafkaTLS  `yaml:"tls"`
+	SASL KafkaSASL `yaml:"sasl"`
+}
+
+// Acknowledgement levels.
+const (
+	AcksNone   = "none"
+	AcksLeader = "leader"
+	AcksAll    = "all"
+)
+
+// setDefaults fills in the optional Kafka settings.
+// Without them the producer behaves as it did with the fixed configuration.
+func (k *KafkaConfig) setDefaults() {
+	if k.Topic == "" {
+		k.Topic = "OrderGo"
+	}
+	if k.Acks == "" {
+		k.Acks = AcksLeader
+		if k.Idempotent {
+			k.Acks = AcksAll
+		}
+	}
+	if k.Retries < 0 {
+		k.Retries = 5
+	}
+	if k.RetryBackoff <= 0 {
+		k.RetryBackoff = 100
+	}
+	if k.Compression == "" {
+		k.Compression = "snappy"
+	}
+	if k.FlushFrequency <= 0 {
+		k.FlushFrequency = 500
+	}
+	if k.MaxMessageBytes <= 0 {
+		k.MaxMessageBytes = 1000000
+	}
+	if k.MaxOpenRequests <= 0 {
+		k.MaxOpenRequests = 1
+	}
+}
+
+// Sarama returns the sarama configuration of the producer.
+// Settings that do not parse or do not go together, such as idempotence with acks other than all, are an error.
+func (k *KafkaConfig) Sarama() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	if k.Version != "" {
+		version, err := sarama.ParseKafkaVersion(k.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	} else if k.Idempotent {
+		config.Version = sarama.V0_11_0_0
+	}
+
+	switch k.Acks {
+	case AcksNone:
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case AcksLeader:
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case AcksAll:
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return nil, fmt.Errorf("unknown acks %q", k.Acks)
+	}
+	if err := config.Producer.Compression.UnmarshalText([]byte(k.Compression)); err != nil {
+		return nil, err
+	}
+
+	if k.ClientID != "" {
+		config.ClientID = k.ClientID
+	}
+	config.Producer.Retry.Max = k.Retries
+	config.Producer.Retry.Backoff = time.Duration(k.RetryBackoff) * time.Millisecond
+	config.Producer.Flush.Frequency = time.Duration(k.FlushFrequency) * time.Millisecond
+	config.Producer.Flush.Messages = k.FlushMessages
+	config.Producer.Flush.Bytes = k.FlushBytes
+	config.Producer.MaxMessageBytes = k.MaxMessageBytes
+	config.Producer.Idempotent = k.Idempotent
+	config.Net.MaxOpenRequests = k.MaxOpenRequests
+	config.Producer.Return.Successes = true
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+
+	if err := k.TLS.apply(config); err != nil {
+		return nil, err
+	}
+	if err := k.SASL.apply(config); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// KafkaTLS holds the TLS settings of the connections to the brokers.
+type KafkaTLS struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"ca_file"`              // CA certificates of the brokers, the system pool if unset.
+	CertFile           string `yaml:"cert_file"`            // Client certificate, for brokers that authenticate clients.
+	KeyFile            string `yaml:"key_file"`             // Key of the client certificate.
+	ServerName         string `yaml:"server_name"`          // Name checked against the broker certificates, the broker host if unset.
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Do not verify the broker certificates.
+}
+
+// KafkaSASL holds the SASL credentials of the producer.
+type KafkaSASL struct {
+	Mechanism    string `yaml:"mechanism"`     // PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, no SASL if unset.
+	Username     string `yaml:"username"`      // User name, read from username_file if unset.
+	UsernameFile string `yaml:"username_file"` // File holding the user name.
+	PasswordFile string `yaml:"password_file"` // File holding the password.
+}
@@ -0,0 +1,87 @@
+package internal
+
+import "sync"
+
+// LossyCounter implements lossy counting (Manku and Motwani).
+// The stream is split into buckets of 1/epsilon observations and at the end
+// of every bucket the keys that cannot be frequent anymore are pruned.
+type LossyCounter struct {
+	mu     sync.Mutex
+	items  map[string]*Record // Tracked keys, Error holds the bucket a key was added in minus one.
+	bucket uint64             // Current bucket, starting at 1.
+	total  uint64             // Observations since the start.
+}
+
+// NewLossyCounter returns an empty lossy counter.
+func NewLossyCounter() *LossyCounter {
+	return &LossyCounter{
+		items:  map[string]*Record{},
+		bucket: 1,
+	}
+}
+
+// Observe records one occurrence of key.
+func (lc *LossyCounter) Observe(key string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.total++
+	if rec, ok := lc.items[key]; ok {
+		rec.Count++
+		return
+	}
+	lc.items[key] = &Record{Key: key, Count: 1, Error: lc.bucket - 1}
+}
+
+// Estimate returns the count of key, or 0 if it is not tracked.
+func (lc *LossyCounter) Estimate(key string) uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if rec, ok := lc.items[key]; ok {
+		return rec.Count
+	}
+	return 0
+}
+
+// TopK returns up to k tracked keys by descending count.
+func (lc *LossyCounter) TopK(k int) []Record {
+	lc.mu.Lock()
+	records := make([]Record, 0, len(lc.items))
+	for _, rec := range lc.items {
+		records = append(records, *rec)
+	}
+	lc.mu.Unlock()
+
+	return sortRecords(records, k)
+}
+
+// EndBucket prunes the keys whose count plus maximum error
+// does not exceed the current bucket and turns the bucket over.
+func (lc *LossyCounter) EndBucket() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	for key, rec := range lc.items {
+		if rec.Count+rec.Error <= lc.bucket {
+			delete(lc.items, key)
+		}
+	}
+	lc.bucket++
+}
+
+// Total returns the number of observations since the start: lossy counting counts the whole stream.
+func (lc *LossyCounter) Total() uint64 {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return lc.total
+}
+
+// Len returns the number of tracked keys.
+func (lc *LossyCounter) Len() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return len(lc.items)
+}
@@ -1,15 +1,35 @@
 package internal
 
 import (
+	"fmt"
 	"math"
 	"sync"
+	"time"
 )
 
 // KeyRecord stores the metadata for a flow.
 type KeyRecord struct {
-	Key       string // The key identifying a flow.
-	Count     uint64 // The `size` of the flow.
-	Partition int    // The partition this key is mapped to.
+	Key       string  `json:"key"`       // The key identifying a flow.
+	Count     uint64  `json:"count"`     // The count of the flow reported by the heavy hitter detector.
+	Weight    float64 `json:"weight"`    // The `size` of the flow: decayed number of messages per bucket.
+	Partition int     `json:"partition"` // The partition this key is mapped to.
+	Demoted   bool    `json:"demoted"`   // The key is not hot anymore and is only held until it goes idle.
+	Pinned    bool    `json:"pinned"`    // An operator pinned the key to its partition.
+	Migrating bool    `json:"migrating"` // The producer holds the key's new message set until the old one drained.
+
+	LastMigrated time.Time `json:"last_migrated"` // When the rebalancer last moved the flow.
+	Migrations   int       `json:"migrations"`    // How many times the rebalancer moved the flow.
+	Flapping     bool      `json:"flapping"`      // The flow kept moving back and forth and is held in place.
+	HeldUntil    time.Time `json:"held_until"`    // End of the hold of a flapping flow.
+	recentMoves  []time.Time
+}
+
+// MigrationPolicy limits how often the rebalancer may move a flow.
+type MigrationPolicy struct {
+	Cooldown      time.Duration // A moved flow is not moved again for this long, 0 to disable.
+	FlapThreshold int           // This many moves within FlapWindow flag a flow as flapping, 0 to disable.
+	FlapWindow    time.Duration
+	FlapHold      time.Duration // How long a flapping flow is held in place.
 }
 
 // PartitionMap stores the flows that have been mapped to each partition.
@@ -17,13 +37,59 @@ type PartitionMap struct {
 	storeMu sync.RWMutex          // Lock the struct before making changes to the store.
 	store   map[int][]*KeyRecord  // A store of flows mapped to partitions.
 	keyMap  map[string]*KeyRecord // Points to the key record of each key.
+
+	seenMu   sync.Mutex           // Lock for lastSeen, kept apart from storeMu as it is taken for every message.
+	lastSeen map[string]time.Time // When a message was last routed with each key record.
+
+	policy  MigrationPolicy // Limits on moving flows.
+	journal Journal         // Records the changes to the store, nil if the state is not persisted.
+
+	healthMu     sync.Mutex               // Lock for health, taken for every acknowledgement.
+	health       map[int]*partitionHealth // Produce errors of the partitions that had any.
+	healthPolicy HealthPolicy
 }
 
 // Return a new Partition Map
 func NewPartitionMap() *PartitionMap {
 	return &PartitionMap{
-		store:  map[int][]*KeyRecord{},
-		keyMap: map[string]*KeyRecord{},
+		store:    map[int][]*KeyRecord{},
+		keyMap:   map[string]*KeyRecord{},
+		lastSeen: map[string]time.Time{},
+		health:   map[int]*partitionHealth{},
+	}
+}
+
+// SetMigrationPolicy sets the limits on moving flows.
+func (pm *PartitionMap) SetMigrationPolicy(policy MigrationPolicy) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	pm.policy = policy
+}
+
+// SetJournal records every later change to the store in j.
+func (pm *PartitionMap) SetJournal(j Journal) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	pm.journal = j
+}
+
+// logRecord journals the current record of a key. Callers hold the lock.
+func (pm *PartitionMap) logRecord(key string) {
+	if pm.journal == nil {
+		return
+	}
+	if kc := pm.getKey(key); kc != nil {
+		rec := *kc
+		pm.journal.Append(JournalEntry{Op: OpMap, Key: key, Record: &rec})
+	}
+}
+
+// logUnmap journals the removal of a key. Callers hold the lock.
+func (pm *PartitionMap) logUnmap(key string) {
+	if pm.journal != nil {
+		pm.journal.Append(JournalEntry{Op: OpUnmap, Key: key})
 	}
 }
 
@@ -35,20 +101,24 @@ func (pm *PartitionMap) PopulateMaps(partitions int) {
 }
 
 // addKey adds a key to the backup store.
-// It is only called from the Rebalance function and thus does not use locking.
-// Rebalance already takes the locks.
-func (pm *PartitionMap) addKey(key string, count uint64, partition int) {
-	kc := KeyRecord{Key: key, Count: count, Partition: partition}
-	pm.store[partition] = append(pm.store[partition], &kc)
-	pm.keyMap[key] = &kc
+// It does not use locking, callers already hold the lock.
+func (pm *PartitionMap) addKey(key string, count uint64, weight float64, partition int) {
+	pm.addRecord(&KeyRecord{Key: key, Count: count, Weight: weight, Partition: partition})
+}
+
+// addRecord adds a key record to the store of its partition. Callers hold the lock.
+func (pm *PartitionMap) addRecord(kc *KeyRecord) {
+	pm.store[kc.Partition] = append(pm.store[kc.Partition], kc)
+	pm.keyMap[kc.Key] = kc
 }
 
 // AddKey adds a key to the backup store.
-func (pm *PartitionMap) AddKey(key string, count uint64, partition int) {
+func (pm *PartitionMap) AddKey(key string, count uint64, weight float64, partition int) {
 	pm.storeMu.Lock()
 	defer pm.storeMu.Unlock()
 
-	pm.addKey(key, count, partition)
+	pm.addKey(key, count, weight, partition)
+	pm.logRecord(key)
 }
 
 // getKey searches and returns the key metadata from the store.
@@ -70,6 +140,96 @@ func (pm *PartitionMap) GetKey(key string) *KeyRecord {
 	return pm.getKey(key)
 }
 
+// Lookup returns a copy of the key metadata, and false if the key is not mapped.
+func (pm *PartitionMap) Lookup(key string) (KeyRecord, bool) {
+	pm.storeMu.RLock()
+	defer pm.storeMu.RUnlock()
+
+	kc := pm.getKey(key)
+	if kc == nil {
+		return KeyRecord{}, false
+	}
+	return *kc, true
+}
+
+// Keys returns every key currently mapped to a partition.
+func (pm *PartitionMap) Keys() []string {
+	pm.storeMu.RLock()
+	defer pm.storeMu.RUnlock()
+
+	keys := make([]string, 0, len(pm.keyMap))
+	for key := range pm.keyMap {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Touch records that a message of a mapped key was just routed.
+func (pm *PartitionMap) Touch(key string) {
+	pm.seenMu.Lock()
+	defer pm.seenMu.Unlock()
+
+	pm.lastSeen[key] = time.Now()
+}
+
+// SetMigrating marks a key as holding its new message set back while the old one drains.
+// The mark is not journaled: held messages do not survive a restart.
+func (pm *PartitionMap) SetMigrating(key string, migrating bool) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	if kc := pm.getKey(key); kc != nil {
+		kc.Migrating = migrating
+	}
+}
+
+// Demote marks a key as no longer hot while keeping it on its partition.
+// Pinned keys are never demoted.
+// Returns false if the key is not mapped or pinned.
+func (pm *PartitionMap) Demote(key string) bool {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	kc := pm.getKey(key)
+	if kc == nil || kc.Pinned {
+		return false
+	}
+	if !kc.Demoted {
+		kc.Demoted = true
+		// The idle time of a demoted key starts with its demotion.
+		pm.Touch(key)
+		pm.logRecord(key)
+	}
+	return true
+}
+
+// Promote clears the demoted mark of a key that became hot again.
+func (pm *PartitionMap) Promote(key string) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	if kc := pm.getKey(key); kc != nil && kc.Demoted {
+		kc.Demoted = false
+		pm.logRecord(key)
+	}
+}
+
+// IdleDemoted returns the demoted keys that have not seen a message for at least `idle`.
+func (pm *PartitionMap) IdleDemoted(idle time.Duration) []string {
+	pm.storeMu.RLock()
+	defer pm.storeMu.RUnlock()
+	pm.seenMu.Lock()
+	defer pm.seenMu.Unlock()
+
+	keys := make([]string, 0)
+	for key, kc := range pm.keyMap {
+		if kc.Demoted && time.Since(pm.lastSeen[key]) >= idle {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
 // deleteKey deletes key from partition in the backup store.
 // Return key metadata or nil if not found.
 func (pm *PartitionMap) deleteKey(key string) *KeyRecord {
@@ -78,6 +238,9 @@ func (pm *PartitionMap) deleteKey(key string) *KeyRecord {
 			if kc.Key == key {
 				pm.store[kc.Partition] = append(pm.store[kc.Partition][:i], pm.store[kc.Partition][i+1:]...) // Delete from the store.
 				delete(pm.keyMap, key)                                                                       // Delete from the keymap.
+				pm.seenMu.Lock()
+				delete(pm.lastSeen, key)
+				pm.seenMu.Unlock()
 				return kc
 			}
 		}
@@ -85,34 +248,160 @@ func (pm *PartitionMap) deleteKey(key string) *KeyRecord {
 	return nil
 }
 
-// DeleteKey deletes key from partition.
-// Returns key metadata or nil if not found.
-func (pm *PartitionMap) DeleteKey(key string) *KeyRecord {
+// Release deletes a key that is not hot anymore. Pinned keys are kept.
+// Returns key metadata or nil if the key was not released.
+func (pm *PartitionMap) Release(key string) *KeyRecord {
 	pm.storeMu.Lock()
 	defer pm.storeMu.Unlock()
 
+	if kc := pm.getKey(key); kc == nil || kc.Pinned {
+		return nil
+	}
+	pm.logUnmap(key)
 	return pm.deleteKey(key)
 }
 
-// MigrateKey moves a key from one partition to another.
-func (pm *PartitionMap) migrateKey(key string, count uint64, dstPartition int) {
+// moveKey moves a key from one partition to another. Callers hold the lock.
+// Returns false if the key is no longer on the source partition.
+func (pm *PartitionMap) moveKey(key string, srcPartition, dstPartition int) bool {
+	kc := pm.getKey(key)
+	if kc == nil || kc.Partition != srcPartition {
+		return false
+	}
+	rec := pm.relocate(kc, dstPartition)
+	pm.recordMigration(rec, time.Now())
+	return true
+}
+
+// relocate moves a key record to another partition, carrying over the state of the flow.
+// Callers hold the lock. Returns the new record.
+func (pm *PartitionMap) relocate(kc *KeyRecord, dstPartition int) *KeyRecord {
+	rec := *kc
+	// Remove from old partition.
+	pm.deleteKey(kc.Key)
+	// Add to new partition.
+	rec.Partition = dstPartition
+	pm.addRecord(&rec)
+	return &rec
+}
+
+// Pin maps a key to a partition and keeps it there until it is unpinned.
+// Keys that are not mapped yet are added. Returns the partition the key was on, -1 if it was not mapped.
+func (pm *PartitionMap) Pin(key string, partition int) (int, KeyRecord) {
 	pm.storeMu.Lock()
 	defer pm.storeMu.Unlock()
-	// If key already exists.
+
 	kc := pm.getKey(key)
-	if kc != nil {
-		// Remove from old partition.
-		pm.deleteKey(key)
+	if kc == nil {
+		rec := &KeyRecord{Key: key, Partition: partition, Pinned: true}
+		pm.addRecord(rec)
+		pm.logRecord(key)
+		return -1, *rec
+	}
+	src := kc.Partition
+	if src != partition {
+		kc = pm.relocate(kc, partition)
+		pm.recordManualMove(kc)
+	}
+	kc.Pinned = true
+	kc.Demoted = false
+	pm.logRecord(key)
+	return src, *kc
+}
+
+// Unpin hands a pinned key back to the rebalancer and the heavy hitter detector.
+// Returns false if the key is not mapped.
+func (pm *PartitionMap) Unpin(key string) (KeyRecord, bool) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	kc := pm.getKey(key)
+	if kc == nil {
+		return KeyRecord{}, false
+	}
+	kc.Pinned = false
+	pm.logRecord(key)
+	return *kc, true
+}
+
+// ForceMove moves a mapped key to a partition regardless of the migration policy.
+// Returns false if the key is not mapped.
+func (pm *PartitionMap) ForceMove(key string, partition int) (Move, bool) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	kc := pm.getKey(key)
+	if kc == nil {
+		return Move{}, false
+	}
+	m := Move{Key: key, Weight: kc.Weight, Src: kc.Partition, Dst: partition}
+	if m.Src != m.Dst {
+		pm.recordManualMove(pm.relocate(kc, partition))
+		pm.logRecord(key)
+	}
+	return m, true
+}
+
+// recordManualMove updates the migration state of a flow moved by an operator.
+// The move starts a cooldown but does not count towards flapping.
+func (pm *PartitionMap) recordManualMove(kc *KeyRecord) {
+	kc.LastMigrated = time.Now()
+	kc.Migrations++
+}
+
+// recordMigration updates the migration state of a flow that was just moved
+// and flags it as flapping if it moved too often within the flap window.
+func (pm *PartitionMap) recordMigration(kc *KeyRecord, now time.Time) {
+	kc.LastMigrated = now
+	kc.Migrations++
+	recent := make([]time.Time, 0, len(kc.recentMoves)+1)
+	for _, at := range kc.recentMoves {
+		if now.Sub(at) < pm.policy.FlapWindow {
+			recent = append(recent, at)
+		}
+	}
+	kc.recentMoves = append(recent, now)
+	if pm.policy.FlapThreshold > 0 && len(kc.recentMoves) >= pm.policy.FlapThreshold {
+		kc.Flapping = true
+		kc.HeldUntil = now.Add(pm.policy.FlapHold)
+	}
+}
+
+// Refresh updates the flow sizes at the end of a bucket.
+// `counts` holds the detector counts and `observed` the messages seen in the bucket.
+// Each weight moves towards the bucket's count by `alpha`, an exponentially weighted moving average,
+// so partition sizes follow the current rate of each flow instead of its lifetime total.
+func (pm *PartitionMap) Refresh(counts, observed map[string]uint64, alpha float64) {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	for key, kc := range pm.keyMap {
+		if count, ok := counts[key]; ok {
+			kc.Count = count
+		}
+		kc.Weight = alpha*float64(observed[key]) + (1-alpha)*kc.Weight
+		// Release flapping flows whose hold is over.
+		if kc.Flapping && time.Now().After(kc.HeldUntil) {
+			kc.Flapping = false
+			kc.recentMoves = nil
+		}
 	}
-	// Add to new partition.
-	pm.addKey(key, count, dstPartition)
+}
+
+// DecayAlpha returns the smoothing factor of a moving average with the given half-life
+// after `elapsed` time: past weights lose half their influence every half-life.
+func DecayAlpha(elapsed, halfLife time.Duration) float64 {
+	if halfLife <= 0 {
+		return 1
+	}
+	return 1 - math.Exp2(-elapsed.Seconds()/halfLife.Seconds())
 }
 
 func (pm *PartitionMap) systemAvgSize() float64 {
 	total := 0.0
 	for _, kcArr := range pm.store {
 		for _, kc := range kcArr {
-			total += float64(kc.Count)
+			total += kc.Weight
 		}
 	}
 	return total / float64(len(pm.store))
@@ -131,7 +420,7 @@ func (pm *PartitionMap) partitionSize(partition int) float64 {
 	for p, kcArr := range pm.store {
 		if p == partition {
 			for _, kc := range kcArr {
-				total += float64(kc.Count)
+				total += kc.Weight
 			}
 		}
 	}
@@ -146,96 +435,79 @@ func (pm *PartitionMap) PartitionSize(partition int) float64 {
 	return pm.partitionSize(partition)
 }
 
-// Rebalance rebalances the backup store.
-func (pm *PartitionMap) Rebalance() {
-	// Divide partitions into greater than and lesser than sets.
-	lessThanParts, grtrThanParts := pm.partitionSets()
-	// For each partition in grtrThanParts
-	for _, p := range *grtrThanParts {
-		// Select the set to be migrated
-		candidates := pm.migrationCandidates(p)
-		if candidates == nil || len(*candidates) == 0 {
-			continue
-		}
-		// Find target partitions for each candidate flow.
-		swapMap := pm.targetMatch(candidates, lessThanParts)
-		for p, kcArr := range *swapMap {
-			for _, kc := range kcArr {
-				pm.migrateKey(kc.Key, kc.Count, p)
-			}
-		}
-	}
-}
-
-// partitionSets returns the current grtrThanParts and lessThanParts.
-func (pm *PartitionMap) partitionSets() (*[]int, *[]int) {
+// PartitionSizes returns the size of every partition.
+func (pm *PartitionMap) PartitionSizes() map[int]float64 {
 	pm.storeMu.RLock()
 	defer pm.storeMu.RUnlock()
 
-	sysAvg := pm.systemAvgSize()
-	lessThanParts := make([]int, 0)
-	grtrThanParts := make([]int, 0)
-	for p := 0; p < len(pm.store); p++ {
-		pSize := pm.partitionSize(p)
-		if pSize < sysAvg {
-			lessThanParts = append(lessThanParts, p)
-		} else if pSize > sysAvg {
-			grtrThanParts = append(grtrThanParts, p)
-		}
+	s := make(map[int]float64, len(pm.store))
+	for p := range pm.store {
+		s[p] = pm.partitionSize(p)
 	}
-	return &lessThanParts, &grtrThanParts
+	return s
 }
 
-// migrationCandidates recalculates the partitionSize and return a set of possible migration candidates.
-func (pm *PartitionMap) migrationCandidates(partition int) *[]KeyRecord {
+// Records returns a copy of every key record.
+func (pm *PartitionMap) Records() []KeyRecord {
 	pm.storeMu.RLock()
 	defer pm.storeMu.RUnlock()
 
-	diff := pm.partitionSize(partition) - pm.systemAvgSize()
-	if diff <= 0 {
-		return nil
+	records := make([]KeyRecord, 0, len(pm.keyMap))
+	for _, kc := range pm.keyMap {
+		records = append(records, *kc)
 	}
-	candidates := make([]KeyRecord, 0)
-	for p, kcArr := range pm.store {
-		if p == partition {
-			for _, kc := range kcArr {
-				if float64(kc.Count) <= diff {
-					candidates = append(candidates, *kc)
-				}
-			}
+	return records
+}
+
+// Restore puts back key records saved by a snapshot or read from a seed file.
+// Records replace the current ones with the same key.
+func (pm *PartitionMap) Restore(records []KeyRecord) error {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	for _, kc := range records {
+		if _, ok := pm.store[kc.Partition]; !ok {
+			return fmt.Errorf("key %q is mapped to unknown partition %d", kc.Key, kc.Partition)
 		}
 	}
-	return &candidates
+	for _, kc := range records {
+		rec := kc
+		rec.Migrating = false // Held messages do not survive a restart.
+		pm.deleteKey(rec.Key)
+		pm.addRecord(&rec)
+	}
+	return nil
 }
 
-// targetMatch will find the best match for each key in candidates and return a pointer to the mappings.
-func (pm *PartitionMap) targetMatch(candidates *[]KeyRecord, lessThanParts *[]int) *map[int][]KeyRecord {
+// Snapshot returns a copy of the store.
+func (pm *PartitionMap) Snapshot() map[int][]KeyRecord {
 	pm.storeMu.RLock()
 	defer pm.storeMu.RUnlock()
 
-	swapMap := make(map[int][]KeyRecord)
-	srcSize := pm.partitionSize((*candidates)[0].Partition)
-	sysAvg := pm.systemAvgSize()
-	for _, kc := range *candidates {
-		dstPartition := kc.Partition
-		dstDiff := math.Inf(1) // Positive infinity.
-		for _, partition := range *lessThanParts {
-			dstSize := pm.partitionSize(partition)
-			// Stopping condition.
-			if srcSize < dstSize || srcSize-dstSize < math.Abs(srcSize-dstSize+2*float64(kc.Count)) {
-				continue
-			}
-			// Best Match.
-			delta := math.Abs(dstSize + float64(kc.Count) - sysAvg)
-			if delta < dstDiff {
-				dstDiff = delta
-				dstPartition = partition
-			}
-		}
-		if dstPartition == kc.Partition { // No candidate for migration was found.
-			continue
+	store := make(map[int][]KeyRecord, len(pm.store))
+	for p, kcArr := range pm.store {
+		store[p] = make([]KeyRecord, len(kcArr))
+		for i, kc := range kcArr {
+			store[p][i] = *kc
 		}
-		swapMap[dstPartition] = append(swapMap[dstPartition], kc)
 	}
-	return &swapMap
+	return store
+}
+
+// stays reports whether a flow must not be moved by a rebalancer.
+func (pm *PartitionMap) stays(kc KeyRecord) bool {
+	now := time.Now()
+	switch {
+	case kc.Pinned: // Pinned keys are placed by an operator.
+		return true
+	case kc.Demoted: // Demoted keys are on their way out, do not move them.
+		return true
+	case kc.Migrating: // Draining keys finish their move first.
+		return true
+	case kc.Flapping && now.Before(kc.HeldUntil): // Flapping flows are held in place.
+		return true
+	case !kc.LastMigrated.IsZero() && now.Sub(kc.LastMigrated) < pm.policy.Cooldown: // Recently moved flows get to settle.
+		return true
+	}
+	return false
 }
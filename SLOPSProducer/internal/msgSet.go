@@ -14,11 +14,11 @@ import (
 // irrespective of changing partitions.
 // To be repeated in consumer.
 type MessageSet struct {
-	Key             string
-	SrcPartition    int32
-	SrcMsgsetIndex  int32
-	DestPartition   int32
-	DestMsgsetIndex int32
+	Key             string `json:"key"`
+	SrcPartition    int32  `json:"src_partition"`
+	SrcMsgsetIndex  int32  `json:"src_msgset_index"`
+	DestPartition   int32  `json:"dest_partition"`
+	DestMsgsetIndex int32  `json:"dest_msgset_index"`
 }
 
 func (m *MessageSet) MarshalBinary() ([]byte, error) {
@@ -45,22 +45,72 @@ func (m *MessageSet) UnmarshalBinary(data []byte) error {
 }
 
 type MessageSetMap struct {
-	mu sync.RWMutex
-	KV map[string]MessageSet
+	mu      sync.RWMutex
+	KV      map[string]MessageSet
+	journal Journal // Records the changes, nil if the state is not persisted.
+
+	// Home returns the partition of a key that is not mapped, its hash partition.
+	// The first message set of a key on its home partition is the one the producer starts
+	// with after a restart anyway, so it is neither journaled nor snapshotted,
+	// unless the key is mapped. Every message set is persisted if unset.
+	Home func(key string) int32
+	// Mapped reports whether a key is in the partition map. A mapped key can leave its home
+	// partition before its next message, so its message set is always persisted.
+	Mapped func(key string) bool
 }
 
-func (m *MessageSetMap) AddKey(rec MessageSet) *MessageSet {
+// rebuilt reports whether a restart starts a key on the same message set without saving it.
+func (m *MessageSetMap) rebuilt(rec MessageSet) bool {
+	return m.Home != nil && rec.DestMsgsetIndex == 0 && rec.DestPartition == m.Home(rec.Key)
+}
+
+// durable reports whether a message set must survive restarts.
+func (m *MessageSetMap) durable(rec MessageSet) bool {
+	return !m.rebuilt(rec) || (m.Mapped != nil && m.Mapped(rec.Key))
+}
+
+// SetJournal records every later change of a message set in j.
+func (m *MessageSetMap) SetJournal(j Journal) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if val, exist := m.KV[rec.Key]; exist {
-		m.KV[rec.Key] = rec
+	m.journal = j
+}
+
+// AddKey sets the message set of a key and returns the previous one, nil if there was none.
+// Calls for a key must come from its dispatch queue, which keeps its journal entries in order
+// without holding the lock during the write.
+func (m *MessageSetMap) AddKey(rec MessageSet) *MessageSet {
+	m.mu.Lock()
+	val, exist := m.KV[rec.Key]
+	m.KV[rec.Key] = rec
+	journal := m.journal
+	m.mu.Unlock()
+
+	if journal != nil && m.durable(rec) {
+		ms := rec
+		journal.Append(JournalEntry{Op: OpMsgset, Key: rec.Key, Msgset: &ms})
+	}
+	if exist {
 		return &val
 	}
-	m.KV[rec.Key] = rec
 	return nil
 }
 
+// Persist journals the message set of a key that is about to be mapped, if it was not journaled yet.
+// It must be called before the mapping is journaled, so a restart never finds the key mapped
+// off its home partition without the message set it left there.
+func (m *MessageSetMap) Persist(key string) {
+	m.mu.RLock()
+	rec, ok := m.KV[key]
+	journal := m.journal
+	m.mu.RUnlock()
+
+	if journal != nil && ok && m.rebuilt(rec) {
+		journal.Append(JournalEntry{Op: OpMsgset, Key: key, Msgset: &rec})
+	}
+}
+
 func (m *MessageSetMap) GetKey(key string) (*MessageSet, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -79,6 +129,35 @@ func (m *MessageSetMap) Del(key string) {
 	delete(m.KV, key)
 }
 
+// Records returns a copy of every message set that must survive restarts.
+func (m *MessageSetMap) Records() []MessageSet {
+	m.mu.RLock()
+	all := make([]MessageSet, 0, len(m.KV))
+	for _, rec := range m.KV {
+		all = append(all, rec)
+	}
+	m.mu.RUnlock()
+
+	// Mapped takes the lock of the partition map, which journals into this map holding it.
+	records := make([]MessageSet, 0)
+	for _, rec := range all {
+		if m.durable(rec) {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// Restore puts back message sets saved by a snapshot, so indexes keep growing across restarts.
+func (m *MessageSetMap) Restore(records []MessageSet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, rec := range records {
+		m.KV[rec.Key] = rec
+	}
+}
+
 func (m *MessageSetMap) Len() int {
 	return len(m.KV)
 }
@@ -0,0 +1,76 @@
+package internal
+
+import "testing"
+
+// recorder is a Journal that keeps the entries in memory.
+type recorder []JournalEntry
+
+func (r *recorder) Append(entry JournalEntry) {
+	*r = append(*r, entry)
+}
+
+func TestMessageSetMapDurable(t *testing.T) {
+	home := func(key string) int32 { return 0 }
+	tests := []struct {
+		name    string
+		rec     MessageSet
+		durable bool
+	}{
+		{"first set on the home partition", MessageSet{Key: "a", SrcPartition: -1, SrcMsgsetIndex: -1, DestPartition: 0}, false},
+		{"first set elsewhere", MessageSet{Key: "b", SrcPartition: -1, SrcMsgsetIndex: -1, DestPartition: 2}, true},
+		{"switched away", MessageSet{Key: "c", SrcPartition: 0, DestPartition: 1, DestMsgsetIndex: 1}, true},
+		{"switched back home", MessageSet{Key: "d", SrcPartition: 1, SrcMsgsetIndex: 1, DestPartition: 0, DestMsgsetIndex: 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var journal recorder
+			m := &MessageSetMap{KV: map[string]MessageSet{}, Home: home}
+			m.SetJournal(&journal)
+			m.AddKey(tt.rec)
+
+			if got := len(journal) == 1; got != tt.durable {
+				t.Errorf("journaled %v, want %v", got, tt.durable)
+			}
+			if got := len(m.Records()) == 1; got != tt.durable {
+				t.Errorf("snapshotted %v, want %v", got, tt.durable)
+			}
+			if _, err := m.GetKey(tt.rec.Key); err != nil {
+				t.Errorf("message set not kept in memory: %v", err)
+			}
+		})
+	}
+}
+
+// TestMessageSetMapMapped checks the first message set of a key on its home partition is
+// persisted once the key is mapped, as the key can leave home before its next message.
+func TestMessageSetMapMapped(t *testing.T) {
+	mapped := map[string]bool{}
+	var journal recorder
+	m := &MessageSetMap{
+		KV:     map[string]MessageSet{},
+		Home:   func(key string) int32 { return 0 },
+		Mapped: func(key string) bool { return mapped[key] },
+	}
+	m.SetJournal(&journal)
+	m.AddKey(MessageSet{Key: "a", SrcPartition: -1, SrcMsgsetIndex: -1, DestPartition: 0})
+	m.AddKey(MessageSet{Key: "b", SrcPartition: -1, SrcMsgsetIndex: -1, DestPartition: 2})
+	if len(journal) != 1 || len(m.Records()) != 1 {
+		t.Fatalf("journaled %d and snapshotted %d message sets before the mapping, want 1", len(journal), len(m.Records()))
+	}
+
+	// The partition map journals the mapping of both keys.
+	mapped["a"], mapped["b"] = true, true
+	m.Persist("a")
+	m.Persist("b")
+	m.Persist("c") // No message set yet.
+
+	if len(journal) != 2 {
+		t.Fatalf("journaled %d message sets, want 2", len(journal))
+	}
+	if entry := journal[1]; entry.Op != OpMsgset || entry.Msgset == nil || entry.Msgset.Key != "a" {
+		t.Errorf("journaled %+v, want the message set of a", entry)
+	}
+	if got := len(m.Records()); got != 2 {
+		t.Errorf("snapshotted %d message sets, want 2", got)
+	}
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status of a rebalance plan.
+const (
+	PlanPending  = "pending"
+	PlanApplied  = "applied"
+	PlanRejected = "rejected"
+	PlanDryRun   = "dry-run"
+)
+
+// ErrNoSuchPlan is returned for plans that are unknown or no longer pending.
+var ErrNoSuchPlan = errors.New("no such pending plan")
+
+// RebalancePlan lists the moves a rebalancer proposes and what they are expected to achieve.
+type RebalancePlan struct {
+	ID              int64           `json:"id"`
+	Strategy        string          `json:"strategy"`
+	Status          string          `json:"status"`
+	CreatedAt       time.Time       `json:"created_at"`
+	Moves           []Move          `json:"moves"`
+	SizesBefore     map[int]float64 `json:"sizes_before"`     // Predicted partition sizes before the moves.
+	SizesAfter      map[int]float64 `json:"sizes_after"`      // Predicted partition sizes after the moves.
+	ImbalanceBefore float64         `json:"imbalance_before"` // Largest partition above the average, as a fraction of the average.
+	ImbalanceAfter  float64         `json:"imbalance_after"`
+	Improvement     float64         `json:"improvement"` // ImbalanceBefore - ImbalanceAfter.
+	Applied         []Move          `json:"applied,omitempty"`
+}
+
+// NewRebalancePlan builds a plan from the moves proposed for a snapshot of the store.
+func NewRebalancePlan(strategy string, store map[int][]KeyRecord, moves []Move) *RebalancePlan {
+	before := sizes(store)
+	after := make(map[int]float64, len(before))
+	for p, size := range before {
+		after[p] = size
+	}
+	for _, m := range moves {
+		after[m.Src] -= m.Weight
+		after[m.Dst] += m.Weight
+	}
+	if moves == nil {
+		moves = []Move{}
+	}
+	plan := &RebalancePlan{
+		Strategy:        strategy,
+		Status:          PlanDryRun,
+		CreatedAt:       time.Now(),
+		Moves:           moves,
+		SizesBefore:     before,
+		SizesAfter:      after,
+		ImbalanceBefore: imbalance(before),
+		ImbalanceAfter:  imbalance(after),
+	}
+	plan.Improvement = plan.ImbalanceBefore - plan.ImbalanceAfter
+	return plan
+}
+
+// Plan computes the moves of a strategy on the current store without applying them.
+// Unhealthy partitions are left out of the plan.
+func (pm *PartitionMap) Plan(strategy string, r Rebalancer) *RebalancePlan {
+	store := pm.Snapshot()
+	pm.dropUnhealthy(store)
+	return NewRebalancePlan(strategy, store, r.Plan(store, pm.stays))
+}
+
+// Apply moves the flows of a plan.
+// A plan approved in manual mode may be old, so every move is checked again:
+// moves whose flow changed partition since the plan was made, whose flow the rebalancer
+// would now leave in place, such as a flow pinned since, flapping or moved within the cooldown,
+// or whose destination became unhealthy, are dropped.
+// Returns the moves that were applied.
+func (pm *PartitionMap) Apply(plan *RebalancePlan) []Move {
+	pm.storeMu.Lock()
+	defer pm.storeMu.Unlock()
+
+	applied := make([]Move, 0, len(plan.Moves))
+	for _, m := range plan.Moves {
+		if !pm.Healthy(m.Dst) {
+			continue
+		}
+		if kc := pm.getKey(m.Key); kc != nil && pm.stays(*kc) {
+			continue
+		}
+		if pm.moveKey(m.Key, m.Src, m.Dst) {
+			pm.logRecord(m.Key)
+			applied = append(applied, m)
+		}
+	}
+	return applied
+}
+
+// PlanQueue holds the plans waiting for an operator's approval.
+type PlanQueue struct {
+	mu     sync.Mutex
+	limit  int                      // Pending plans kept, the oldest are dropped.
+	nextID int64                    // ID of the next plan.
+	plans  map[int64]*RebalancePlan // Pending plans.
+}
+
+// NewPlanQueue returns a queue that keeps at most `limit` pending plans.
+func NewPlanQueue(limit int) *PlanQueue {
+	if limit < 1 {
+		limit = 1
+	}
+	return &PlanQueue{
+		limit:  limit,
+		nextID: 1,
+		plans:  map[int64]*RebalancePlan{},
+	}
+}
+
+// Add queues a plan for approval and returns its ID.
+func (pq *PlanQueue) Add(plan *RebalancePlan) int64 {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	return pq.add(plan)
+}
+
+// add queues a plan. Callers hold the lock.
+func (pq *PlanQueue) add(plan *RebalancePlan) int64 {
+	plan.ID = pq.nextID
+	plan.Status = PlanPending
+	pq.nextID++
+	pq.plans[plan.ID] = plan
+	// Drop the oldest plans over the limit.
+	for len(pq.plans) > pq.limit {
+		oldest := plan.ID
+		for id := range pq.plans {
+			if id < oldest {
+				oldest = id
+			}
+		}
+		delete(pq.plans, oldest)
+	}
+	return plan.ID
+}
+
+// AddNew queues a plan unless it moves the same flows as the newest pending plan,
+// as the rebalancer keeps proposing the same moves until a plan is applied.
+// Returns the ID of the plan and whether it was queued.
+func (pq *PlanQueue) AddNew(plan *RebalancePlan) (int64, bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	var newest *RebalancePlan
+	for _, p := range pq.plans {
+		if newest == nil || p.ID > newest.ID {
+			newest = p
+		}
+	}
+	if newest != nil && sameMoves(newest.Moves, plan.Moves) {
+		return newest.ID, false
+	}
+	return pq.add(plan), true
+}
+
+// sameMoves reports whether two plans move the same flows between the same partitions.
+// Weights are left out as they decay between two rounds.
+func sameMoves(a, b []Move) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Src != b[i].Src || a[i].Dst != b[i].Dst {
+			return false
+		}
+	}
+	return true
+}
+
+// Get returns a copy of a pending plan.
+func (pq *PlanQueue) Get(id int64) (RebalancePlan, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	plan, ok := pq.plans[id]
+	if !ok {
+		return RebalancePlan{}, ErrNoSuchPlan
+	}
+	return *plan, nil
+}
+
+// Pending returns copies of the pending plans, oldest first.
+func (pq *PlanQueue) Pending() []RebalancePlan {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	plans := make([]RebalancePlan, 0, len(pq.plans))
+	for _, plan := range pq.plans {
+		plans = append(plans, *plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].ID < plans[j].ID })
+	return plans
+}
+
+// Take removes a pending plan from the queue so it can be applied or rejected.
+func (pq *PlanQueue) Take(id int64) (*RebalancePlan, error) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	plan, ok := pq.plans[id]
+	if !ok {
+		return nil, ErrNoSuchPlan
+	}
+	delete(pq.plans, id)
+	return plan, nil
+}
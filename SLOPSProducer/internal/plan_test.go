@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPlanQueue(t *testing.T) {
+	moveA := []Move{{Key: "a", Weight: 2, Src: 0, Dst: 1}}
+	moveADecayed := []Move{{Key: "a", Weight: 1, Src: 0, Dst: 1}}
+	moveB := []Move{{Key: "b", Weight: 2, Src: 1, Dst: 0}}
+
+	tests := []struct {
+		name    string
+		limit   int
+		add     [][]Move // Plans queued with AddNew.
+		queued  []bool
+		pending []int64
+	}{
+		{
+			name:    "distinct plans",
+			limit:   4,
+			add:     [][]Move{moveA, moveB},
+			queued:  []bool{true, true},
+			pending: []int64{1, 2},
+		},
+		{
+			name:    "same moves as the newest plan",
+			limit:   4,
+			add:     [][]Move{moveA, moveA, moveADecayed},
+			queued:  []bool{true, false, false},
+			pending: []int64{1},
+		},
+		{
+			name:    "same moves as an older plan",
+			limit:   4,
+			add:     [][]Move{moveA, moveB, moveA},
+			queued:  []bool{true, true, true},
+			pending: []int64{1, 2, 3},
+		},
+		{
+			name:    "oldest plans dropped over the limit",
+			limit:   2,
+			add:     [][]Move{moveA, moveB, moveA},
+			queued:  []bool{true, true, true},
+			pending: []int64{2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pq := NewPlanQueue(tt.limit)
+			for i, moves := range tt.add {
+				if _, queued := pq.AddNew(&RebalancePlan{Moves: moves}); queued != tt.queued[i] {
+					t.Errorf("plan %d queued %v, want %v", i, queued, tt.queued[i])
+				}
+			}
+			pending := pq.Pending()
+			if len(pending) != len(tt.pending) {
+				t.Fatalf("%d pending plans, want %d", len(pending), len(tt.pending))
+			}
+			for i, plan := range pending {
+				if plan.ID != tt.pending[i] || plan.Status != PlanPending {
+					t.Errorf("pending plan %d is %d %s, want %d %s", i, plan.ID, plan.Status, tt.pending[i], PlanPending)
+				}
+			}
+		})
+	}
+}
+
+func TestPlanQueueTake(t *testing.T) {
+	pq := NewPlanQueue(4)
+	id := pq.Add(&RebalancePlan{})
+	if _, err := pq.Get(id); err != nil {
+		t.Fatalf("get %d: %v", id, err)
+	}
+	if _, err := pq.Take(id); err != nil {
+		t.Fatalf("take %d: %v", id, err)
+	}
+	if _, err := pq.Take(id); !errors.Is(err, ErrNoSuchPlan) {
+		t.Errorf("second take: %v, want %v", err, ErrNoSuchPlan)
+	}
+	if _, err := pq.Get(id); !errors.Is(err, ErrNoSuchPlan) {
+		t.Errorf("get after take: %v, want %v", err, ErrNoSuchPlan)
+	}
+	if next := pq.Add(&RebalancePlan{}); next != id+1 {
+		t.Errorf("next id %d, want %d", next, id+1)
+	}
+}
+
+// TestApplyApprovedPlan applies a plan approved after the flow it moves changed:
+// the move must be dropped whenever the rebalancer would leave the flow in place now.
+func TestApplyApprovedPlan(t *testing.T) {
+	move := func(key string, src, dst int) *RebalancePlan {
+		return &RebalancePlan{Moves: []Move{{Key: key, Weight: 5, Src: src, Dst: dst}}}
+	}
+	tests := []struct {
+		name    string
+		policy  MigrationPolicy
+		since   func(pm *PartitionMap) // What happened to flow a, on partition 0, since the plan was made.
+		plan    *RebalancePlan
+		applied bool
+	}{
+		{
+			name:    "unchanged",
+			since:   func(pm *PartitionMap) {},
+			plan:    move("a", 0, 1),
+			applied: true,
+		},
+		{
+			name:  "pinned",
+			since: func(pm *PartitionMap) { pm.Pin("a", 0) },
+			plan:  move("a", 0, 1),
+		},
+		{
+			name:  "demoted",
+			since: func(pm *PartitionMap) { pm.Demote("a") },
+			plan:  move("a", 0, 1),
+		},
+		{
+			name:   "moved within the cooldown",
+			policy: MigrationPolicy{Cooldown: time.Minute},
+			since:  func(pm *PartitionMap) { pm.Apply(move("a", 0, 1)) },
+			plan:   move("a", 1, 2),
+		},
+		{
+			name:   "flapping",
+			policy: MigrationPolicy{FlapThreshold: 2, FlapWindow: time.Minute, FlapHold: time.Minute},
+			since: func(pm *PartitionMap) {
+				pm.Apply(move("a", 0, 1))
+				pm.Apply(move("a", 1, 0))
+			},
+			plan: move("a", 0, 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := NewPartitionMap()
+			pm.PopulateMaps(3)
+			pm.SetMigrationPolicy(tt.policy)
+			pm.AddKey("a", 5, 5, 0)
+			tt.since(pm)
+			before := pm.GetKey("a").Partition
+
+			applied := pm.Apply(tt.plan)
+			if got := len(applied) == 1; got != tt.applied {
+				t.Fatalf("applied %v, want %v", applied, tt.applied)
+			}
+			want := before
+			if tt.applied {
+				want = tt.plan.Moves[0].Dst
+			}
+			if got := pm.GetKey("a").Partition; got != want {
+				t.Errorf("flow on partition %d, want %d", got, want)
+			}
+		})
+	}
+}
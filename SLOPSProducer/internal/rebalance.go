@@ -0,0 +1,292 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Move is a flow migration proposed by a Rebalancer.
+type Move struct {
+	Key    string  `json:"key"`
+	Weight float64 `json:"weight"`
+	Src    int     `json:"src"`
+	Dst    int     `json:"dst"`
+}
+
+// Rebalancer decides which flows to move between partitions.
+type Rebalancer interface {
+	// Plan returns the moves that rebalance `store`, a snapshot of the partition map.
+	// Flows for which `stay` returns true count towards their partition's size but must not be moved.
+	Plan(store map[int][]KeyRecord, stay func(KeyRecord) bool) []Move
+}
+
+// Names of the rebalancing strategies.
+const (
+	GreedyRebalancer           = "greedy"
+	ToleranceRebalancer        = "tolerance"
+	StateTrackingRebalancer    = "state-tracking"
+	StateTrackingTolRebalancer = "state-tracking-tol"
+	LPTRebalancer              = "lpt"
+)
+
+// NewRebalancer returns the strategy selected in the configuration.
+// The state-tracking strategies run almost continuously, see `Config.RebalanceEvery`.
+func NewRebalancer(conf *Config) (Rebalancer, error) {
+	switch conf.Rebalancer {
+	case "", GreedyRebalancer, "main":
+		return Greedy{}, nil
+	case ToleranceRebalancer, "main-tolerance":
+		return Tolerance{Inner: Greedy{}, Threshold: conf.RebalanceTolerance}, nil
+	case StateTrackingRebalancer:
+		return StateTracking{Hold: seconds(conf.StateHold)}, nil
+	case StateTrackingTolRebalancer:
+		return Tolerance{Inner: StateTracking{Hold: seconds(conf.StateHold)}, Threshold: conf.RebalanceTolerance}, nil
+	case LPTRebalancer:
+		return LPT{}, nil
+	default:
+		return nil, fmt.Errorf("unknown rebalancer %q", conf.Rebalancer)
+	}
+}
+
+// sizes returns the size of every partition of a snapshot.
+func sizes(store map[int][]KeyRecord) map[int]float64 {
+	s := make(map[int]float64, len(store))
+	for p, kcArr := range store {
+		s[p] = 0
+		for _, kc := range kcArr {
+			s[p] += kc.Weight
+		}
+	}
+	return s
+}
+
+// average returns the mean partition size.
+func average(s map[int]float64) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, size := range s {
+		total += size
+	}
+	return total / float64(len(s))
+}
+
+// imbalance returns how far the largest partition is above the average, relative to the average.
+func imbalance(s map[int]float64) float64 {
+	avg := average(s)
+	if avg == 0 {
+		return 0
+	}
+	max := 0.0
+	for _, size := range s {
+		max = math.Max(max, size)
+	}
+	return (max - avg) / avg
+}
+
+// sortedPartitions returns the partitions of a snapshot in ascending order.
+func sortedPartitions(s map[int]float64) []int {
+	partitions := make([]int, 0, len(s))
+	for p := range s {
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+	return partitions
+}
+
+// Greedy is the basic SMALOPS strategy.
+// Partitions above the average size offer the flows that are no larger than their excess,
+// and each flow goes to the partition below the average that it brings closest to the average,
+// as long as the move narrows the gap between the two partitions.
+type Greedy struct{}
+
+// Plan implements Rebalancer.
+func (Greedy) Plan(store map[int][]KeyRecord, stay func(KeyRecord) bool) []Move {
+	s := sizes(store)
+	sysAvg := average(s)
+
+	// Divide partitions into greater than and lesser than sets.
+	lessThanParts := make([]int, 0)
+	grtrThanParts := make([]int, 0)
+	for _, p := range sortedPartitions(s) {
+		if s[p] < sysAvg {
+			lessThanParts = append(lessThanParts, p)
+		} else if s[p] > sysAvg {
+			grtrThanParts = append(grtrThanParts, p)
+		}
+	}
+
+	moves := make([]Move, 0)
+	// For each partition in grtrThanParts
+	for _, src := range grtrThanParts {
+		for _, kc := range store[src] {
+			// Select the set to be migrated.
+			diff := s[src] - sysAvg
+			if diff <= 0 {
+				break
+			}
+			if stay(kc) || kc.Weight > diff {
+				continue
+			}
+			// Find the best target partition for the flow.
+			dst := src
+			dstDiff := math.Inf(1) // Positive infinity.
+			for _, p := range lessThanParts {
+				if s[p] >= sysAvg { // Filled up by earlier moves.
+					continue
+				}
+				gap := s[src] - s[p]
+				// Stopping condition: the move must narrow the gap between the two partitions.
+				if gap <= 0 || gap <= math.Abs(gap-2*kc.Weight) {
+					continue
+				}
+				// Best Match.
+				delta := math.Abs(s[p] + kc.Weight - sysAvg)
+				if delta < dstDiff {
+					dstDiff = delta
+					dst = p
+				}
+			}
+			if dst == src { // No candidate for migration was found.
+				continue
+			}
+			moves = append(moves, Move{Key: kc.Key, Weight: kc.Weight, Src: src, Dst: dst})
+			s[src] -= kc.Weight
+			s[dst] += kc.Weight
+		}
+	}
+	return moves
+}
+
+// StateTracking moves at most one flow per round, which suits rounds that are only
+// `rebalance_sleep` milliseconds apart: the load is measured again after every move.
+// The flow leaves the largest partition for the smallest one and is the one that brings
+// the smallest partition closest to the average, as long as the move narrows the gap
+// between the two. Flows moved within Hold are left alone, so that their new
+// partition's size reflects them before they are considered again.
+type StateTracking struct {
+	Hold time.Duration
+}
+
+// Plan implements Rebalancer.
+func (st StateTracking) Plan(store map[int][]KeyRecord, stay func(KeyRecord) bool) []Move {
+	s := sizes(store)
+	partitions := sortedPartitions(s)
+	if len(partitions) < 2 {
+		return nil
+	}
+	src, dst := partitions[0], partitions[0]
+	for _, p := range partitions {
+		if s[p] > s[src] {
+			src = p
+		}
+		if s[p] < s[dst] {
+			dst = p
+		}
+	}
+	gap := s[src] - s[dst]
+	if gap <= 0 {
+		return nil
+	}
+
+	sysAvg := average(s)
+	now := time.Now()
+	var best *KeyRecord
+	bestDiff := math.Inf(1)
+	for i, kc := range store[src] {
+		if stay(kc) || (!kc.LastMigrated.IsZero() && now.Sub(kc.LastMigrated) < st.Hold) {
+			continue
+		}
+		// Stopping condition: the move must narrow the gap between the two partitions.
+		if gap <= math.Abs(gap-2*kc.Weight) {
+			continue
+		}
+		// Best Match, ties go to the first flow of the partition.
+		delta := math.Abs(s[dst] + kc.Weight - sysAvg)
+		if delta < bestDiff {
+			bestDiff = delta
+			best = &store[src][i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return []Move{{Key: best.Key, Weight: best.Weight, Src: src, Dst: dst}}
+}
+
+// Tolerance skips rebalancing while the imbalance is within a threshold.
+// The imbalance is how far the largest partition is above the average, as a fraction of the average.
+type Tolerance struct {
+	Inner     Rebalancer
+	Threshold float64
+}
+
+// Plan implements Rebalancer.
+func (t Tolerance) Plan(store map[int][]KeyRecord, stay func(KeyRecord) bool) []Move {
+	if imbalance(sizes(store)) <= t.Threshold {
+		return nil
+	}
+	return t.Inner.Plan(store, stay)
+}
+
+// LPT reassigns the flows with the Longest Processing Time first heuristic:
+// flows are placed largest first, each on the partition that is smallest at that point.
+// The plan is only returned if it lowers the size of the largest partition.
+type LPT struct{}
+
+// Plan implements Rebalancer.
+func (LPT) Plan(store map[int][]KeyRecord, stay func(KeyRecord) bool) []Move {
+	before := sizes(store)
+	partitions := sortedPartitions(before)
+	if len(partitions) == 0 {
+		return nil
+	}
+
+	// Flows that stay are placed first.
+	after := make(map[int]float64, len(partitions))
+	flows := make([]KeyRecord, 0)
+	for _, p := range partitions {
+		after[p] = 0
+		for _, kc := range store[p] {
+			if stay(kc) {
+				after[p] += kc.Weight
+			} else {
+				flows = append(flows, kc)
+			}
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		if flows[i].Weight == flows[j].Weight {
+			return flows[i].Key < flows[j].Key
+		}
+		return flows[i].Weight > flows[j].Weight
+	})
+
+	moves := make([]Move, 0)
+	for _, kc := range flows {
+		// Ties go to the current partition to avoid pointless moves.
+		dst := kc.Partition
+		for _, p := range partitions {
+			if after[p] < after[dst] {
+				dst = p
+			}
+		}
+		after[dst] += kc.Weight
+		if dst != kc.Partition {
+			moves = append(moves, Move{Key: kc.Key, Weight: kc.Weight, Src: kc.Partition, Dst: dst})
+		}
+	}
+
+	maxBefore, maxAfter := 0.0, 0.0
+	for _, p := range partitions {
+		maxBefore = math.Max(maxBefore, before[p])
+		maxAfter = math.Max(maxAfter, after[p])
+	}
+	if maxAfter >= maxBefore {
+		return nil
+	}
+	return moves
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// flows builds the records of partition p from alternating keys and weights.
+func flows(p int, kw ...interface{}) []KeyRecord {
+	recs := make([]KeyRecord, 0, len(kw)/2)
+	for i := 0; i < len(kw); i += 2 {
+		recs = append(recs, KeyRecord{Key: kw[i].(string), Weight: float64(kw[i+1].(int)), Partition: p})
+	}
+	return recs
+}
+
+// staying returns a stay function for the given keys.
+func staying(keys ...string) func(KeyRecord) bool {
+	return func(kc KeyRecord) bool {
+		for _, key := range keys {
+			if kc.Key == key {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestRebalancers(t *testing.T) {
+	recent := func(store map[int][]KeyRecord, key string, at time.Time) map[int][]KeyRecord {
+		for p := range store {
+			for i := range store[p] {
+				if store[p][i].Key == key {
+					store[p][i].LastMigrated = at
+				}
+			}
+		}
+		return store
+	}
+	tests := []struct {
+		name  string
+		r     Rebalancer
+		store map[int][]KeyRecord
+		stay  []string
+		want  []Move
+	}{
+		{
+			name:  "greedy balanced",
+			r:     Greedy{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 5), 1: flows(1, "b", 5)},
+		},
+		{
+			name:  "greedy fills up to the average",
+			r:     Greedy{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 6, "b", 2, "c", 2), 1: flows(1, "d", 2)},
+			want:  []Move{{Key: "b", Weight: 2, Src: 0, Dst: 1}, {Key: "c", Weight: 2, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "greedy leaves staying flows",
+			r:     Greedy{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 6, "b", 2, "c", 2), 1: flows(1, "d", 2)},
+			stay:  []string{"b"},
+			want:  []Move{{Key: "c", Weight: 2, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "greedy best match",
+			r:     Greedy{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 3, "b", 3, "c", 3), 1: nil, 2: flows(2, "d", 3)},
+			want:  []Move{{Key: "a", Weight: 3, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "tolerance within threshold",
+			r:     Tolerance{Inner: Greedy{}, Threshold: 0.6},
+			store: map[int][]KeyRecord{0: flows(0, "a", 4, "b", 2), 1: flows(1, "c", 2)},
+		},
+		{
+			name:  "tolerance beyond threshold",
+			r:     Tolerance{Inner: Greedy{}, Threshold: 0.4},
+			store: map[int][]KeyRecord{0: flows(0, "a", 4, "b", 2), 1: flows(1, "c", 2)},
+			want:  []Move{{Key: "b", Weight: 2, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "lpt no improvement",
+			r:     LPT{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 5), 1: flows(1, "b", 5)},
+		},
+		{
+			name:  "lpt largest first",
+			r:     LPT{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 4, "b", 3, "c", 2, "d", 1), 1: nil},
+			want:  []Move{{Key: "b", Weight: 3, Src: 0, Dst: 1}, {Key: "c", Weight: 2, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "lpt places staying flows first",
+			r:     LPT{},
+			store: map[int][]KeyRecord{0: flows(0, "a", 4, "b", 3, "c", 2, "d", 1), 1: nil},
+			stay:  []string{"b"},
+			want:  []Move{{Key: "a", Weight: 4, Src: 0, Dst: 1}, {Key: "d", Weight: 1, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "state tracking balanced",
+			r:     StateTracking{Hold: time.Minute},
+			store: map[int][]KeyRecord{0: flows(0, "a", 5), 1: flows(1, "b", 5)},
+		},
+		{
+			name:  "state tracking moves one flow",
+			r:     StateTracking{Hold: time.Minute},
+			store: map[int][]KeyRecord{0: flows(0, "a", 5, "b", 3), 1: flows(1, "c", 2)},
+			want:  []Move{{Key: "b", Weight: 3, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "state tracking largest to smallest",
+			r:     StateTracking{Hold: time.Minute},
+			store: map[int][]KeyRecord{0: flows(0, "a", 4, "b", 3), 1: flows(1, "c", 2), 2: nil},
+			want:  []Move{{Key: "b", Weight: 3, Src: 0, Dst: 2}},
+		},
+		{
+			name:  "state tracking holds recently moved flows",
+			r:     StateTracking{Hold: time.Minute},
+			store: recent(map[int][]KeyRecord{0: flows(0, "a", 5, "b", 3), 1: flows(1, "c", 2)}, "b", time.Now()),
+			want:  []Move{{Key: "a", Weight: 5, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "state tracking hold over",
+			r:     StateTracking{Hold: time.Minute},
+			store: recent(map[int][]KeyRecord{0: flows(0, "a", 5, "b", 3), 1: flows(1, "c", 2)}, "b", time.Now().Add(-time.Hour)),
+			want:  []Move{{Key: "b", Weight: 3, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "state tracking leaves staying flows",
+			r:     StateTracking{Hold: time.Minute},
+			store: map[int][]KeyRecord{0: flows(0, "a", 5, "b", 3), 1: flows(1, "c", 2)},
+			stay:  []string{"b"},
+			want:  []Move{{Key: "a", Weight: 5, Src: 0, Dst: 1}},
+		},
+		{
+			name:  "state tracking must narrow the gap",
+			r:     StateTracking{Hold: time.Minute},
+			store: map[int][]KeyRecord{0: flows(0, "a", 6), 1: flows(1, "b", 4)},
+		},
+		{
+			name:  "state tracking tolerance",
+			r:     Tolerance{Inner: StateTracking{Hold: time.Minute}, Threshold: 0.6},
+			store: map[int][]KeyRecord{0: flows(0, "a", 5, "b", 3), 1: flows(1, "c", 2)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.r.Plan(tt.store, staying(tt.stay...))
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("moves %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// SpaceSavingCounter implements the Space-Saving algorithm (Metwally et al.).
+// It keeps a fixed number of counters. An unknown key takes over the
+// smallest counter and inherits its count as the error bound.
+// The counters are halved every bucket, so they follow the current rate of the keys.
+type SpaceSavingCounter struct {
+	mu       sync.Mutex
+	capacity int      // Number of counters.
+	counters *minHeap // Counters, smallest on top.
+	total    uint64   // Observations, halved every bucket like the counters.
+}
+
+// NewSpaceSaving returns a Space-Saving counter with `capacity` counters.
+func NewSpaceSaving(capacity int) *SpaceSavingCounter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &SpaceSavingCounter{
+		capacity: capacity,
+		counters: newMinHeap(capacity),
+	}
+}
+
+// Observe records one occurrence of key.
+func (ss *SpaceSavingCounter) Observe(key string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.total++
+	if rec := ss.counters.get(key); rec != nil {
+		rec.Count++
+		ss.counters.fix(key)
+		return
+	}
+	if ss.counters.Len() < ss.capacity {
+		heap.Push(ss.counters, &Record{Key: key, Count: 1})
+		return
+	}
+	min := ss.counters.records[0]
+	ss.counters.replaceMin(&Record{Key: key, Count: min.Count + 1, Error: min.Count})
+}
+
+// Estimate returns the count of key, or 0 if it holds no counter.
+func (ss *SpaceSavingCounter) Estimate(key string) uint64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if rec := ss.counters.get(key); rec != nil {
+		return rec.Count
+	}
+	return 0
+}
+
+// TopK returns up to k tracked keys by descending count.
+func (ss *SpaceSavingCounter) TopK(k int) []Record {
+	ss.mu.Lock()
+	records := ss.counters.snapshot()
+	ss.mu.Unlock()
+
+	return sortRecords(records, k)
+}
+
+// EndBucket halves every counter and its error.
+// Halving keeps the order of the counters, so the heap stays valid.
+func (ss *SpaceSavingCounter) EndBucket() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for _, rec := range ss.counters.records {
+		rec.Count /= 2
+		rec.Error /= 2
+	}
+	ss.total /= 2
+}
+
+// Total returns the decayed number of observations.
+func (ss *SpaceSavingCounter) Total() uint64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.total
+}
+
+// Len returns the number of tracked keys.
+func (ss *SpaceSavingCounter) Len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	return ss.counters.Len()
+}
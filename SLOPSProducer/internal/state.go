@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// State is a snapshot of the partition map and the message sets.
+// It is also the format of the seed files that prepare the partition map of an experiment.
+type State struct {
+	TakenAt     time.Time    `json:"taken_at"`
+	Partitions  int32        `json:"partitions"`
+	Keys        []KeyRecord  `json:"keys"`
+	MessageSets []MessageSet `json:"msgsets"`
+}
+
+// Operations recorded in the write-ahead log.
+const (
+	OpMap    = "map"    // A key record was added or changed.
+	OpUnmap  = "unmap"  // A key was removed from the partition map.
+	OpMsgset = "msgset" // The message set of a key changed.
+)
+
+// JournalEntry is a change to the partition map or the message sets.
+// Entries carry the whole record, so replaying them is idempotent.
+type JournalEntry struct {
+	Op     string      `json:"op"`
+	Key    string      `json:"key"`
+	Record *KeyRecord  `json:"record,omitempty"`
+	Msgset *MessageSet `json:"msgset,omitempty"`
+}
+
+// Journal records the changes to the partition map and the message sets.
+type Journal interface {
+	Append(entry JournalEntry)
+}
+
+// replayer applies journal entries on top of a state.
+type replayer struct {
+	keys    map[string]KeyRecord
+	msgsets map[string]MessageSet
+}
+
+func newReplayer(state *State) *replayer {
+	r := &replayer{
+		keys:    make(map[string]KeyRecord, len(state.Keys)),
+		msgsets: make(map[string]MessageSet, len(state.MessageSets)),
+	}
+	for _, kc := range state.Keys {
+		r.keys[kc.Key] = kc
+	}
+	for _, ms := range state.MessageSets {
+		r.msgsets[ms.Key] = ms
+	}
+	return r
+}
+
+func (r *replayer) apply(entry JournalEntry) {
+	switch entry.Op {
+	case OpMap:
+		if entry.Record != nil {
+			r.keys[entry.Key] = *entry.Record
+		}
+	case OpUnmap:
+		delete(r.keys, entry.Key)
+	case OpMsgset:
+		if entry.Msgset != nil {
+			r.msgsets[entry.Key] = *entry.Msgset
+		}
+	}
+}
+
+// result writes the replayed records back to the state.
+func (r *replayer) result(state *State) {
+	state.Keys = make([]KeyRecord, 0, len(r.keys))
+	for _, kc := range r.keys {
+		state.Keys = append(state.Keys, kc)
+	}
+	state.MessageSets = make([]MessageSet, 0, len(r.msgsets))
+	for _, ms := range r.msgsets {
+		state.MessageSets = append(state.MessageSets, ms)
+	}
+}
+
+// ReadState reads a snapshot or a seed file.
+func ReadState(path string) (*State, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// StateStore persists the state in a directory: a snapshot and a write-ahead log of the changes since.
+// When a snapshot is taken the log is rotated to `wal.old`, which is removed once the snapshot is written.
+type StateStore struct {
+	dir string
+
+	mu  sync.Mutex
+	wal *os.File
+	w   *bufio.Writer
+	err error // First failed write since the last snapshot.
+}
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.jsonl"
+	oldWalFile   = "wal.old.jsonl"
+)
+
+// OpenStateStore opens the state directory, creating it if needed.
+func OpenStateStore(dir string) (*StateStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ss := &StateStore{dir: dir}
+	if err := ss.openWal(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func (ss *StateStore) path(name string) string {
+	return filepath.Join(ss.dir, name)
+}
+
+// openWal opens the log for appending. Callers hold the lock.
+func (ss *StateStore) openWal() error {
+	f, err := os.OpenFile(ss.path(walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	ss.wal = f
+	ss.w = bufio.NewWriter(f)
+	return nil
+}
+
+// Load returns the persisted state: the snapshot with the logs replayed on top.
+// Returns nil if nothing was persisted yet.
+func (ss *StateStore) Load() (*State, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	state, err := ReadState(ss.path(snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		state = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	found := state != nil
+	if state == nil {
+		state = &State{}
+	}
+	r := newReplayer(state)
+	for _, name := range []string{oldWalFile, walFile} {
+		n, err := r.replay(ss.path(name))
+		if err != nil {
+			return nil, err
+		}
+		found = found || n > 0
+	}
+	if !found {
+		return nil, nil
+	}
+	r.result(state)
+	return state, nil
+}
+
+// replay applies the entries of a log and returns how many there were.
+// Lines that do not parse, torn by a crash in the middle of a write, are skipped.
+func (r *replayer) replay(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		r.apply(entry)
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return n, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
+
+// Append implements Journal.
+func (ss *StateStore) Append(entry JournalEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		ss.fail(err)
+		return
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if _, err := ss.w.Write(append(data, '\n')); err != nil {
+		ss.setErr(err)
+		return
+	}
+	if err := ss.w.Flush(); err != nil {
+		ss.setErr(err)
+	}
+}
+
+func (ss *StateStore) fail(err error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	ss.setErr(err)
+}
+
+// setErr keeps the first error. Callers hold the lock.
+func (ss *StateStore) setErr(err error) {
+	if ss.err == nil {
+		ss.err = err
+	}
+}
+
+// Snapshot writes the state returned by `capture` and drops the log it replaces.
+// `capture` is called after the log is rotated, so every change it misses is in the new log.
+// Returns the first log write that failed since the previous snapshot, if any.
+func (ss *StateStore) Snapshot(capture func() *State) error {
+	ss.mu.Lock()
+	walErr := ss.err
+	ss.err = nil
+	if err := ss.rotate(); err != nil {
+		ss.mu.Unlock()
+		return err
+	}
+	ss.mu.Unlock()
+
+	if err := writeState(ss.path(snapshotFile), capture()); err != nil {
+		return err
+	}
+	if err := os.Remove(ss.path(oldWalFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if walErr != nil {
+		return fmt.Errorf("write-ahead log: %w", walErr)
+	}
+	return nil
+}
+
+// rotate moves the current log to `wal.old` and opens a new one. Callers hold the lock.
+// An older `wal.old`, left by a failed snapshot, is merged in so no change is lost.
+func (ss *StateStore) rotate() error {
+	if err := ss.w.Flush(); err != nil {
+		return err
+	}
+	if err := ss.wal.Sync(); err != nil {
+		return err
+	}
+	if err := ss.wal.Close(); err != nil {
+		return err
+	}
+	if err := appendFile(ss.path(oldWalFile), ss.path(walFile)); err != nil {
+		return err
+	}
+	if err := os.Remove(ss.path(walFile)); err != nil {
+		return err
+	}
+	return ss.openWal()
+}
+
+// appendFile appends the content of src to dst.
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeState replaces a state file atomically.
+func writeState(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Close flushes and closes the log.
+func (ss *StateStore) Close() error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if err := ss.w.Flush(); err != nil {
+		ss.wal.Close()
+		return err
+	}
+	return ss.wal.Close()
+}